@@ -0,0 +1,205 @@
+package bench
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// maxSinkLine bounds a line from a sender, a connection with every bucket of
+// its histograms and a thousand topics fits many times over
+const maxSinkLine = 64 << 20
+
+// sender is what the aggregator has from one --results-sink sender
+type sender struct {
+	name    string
+	config  *Config
+	results []Statistics
+	done    *sinkDone
+}
+
+// senderEvent is a line from a sender, or err set when it left. Lines of one
+// sender arrive in order
+type senderEvent struct {
+	sender *sender
+	line   sinkLine
+	err    error
+}
+
+// aggregateSenders listens on Config.Aggregator for senders and merges their
+// results into one report, once Config.Senders senders are done or ctx is.
+// Senders can join at any time and leave before they are done, which the
+// report counts as a violation
+func (r *Runner) aggregateSenders(ctx context.Context) (*Report, error) {
+	listener, err := net.Listen("tcp", r.opts.Aggregator)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	r.log.Info("waiting for results", "addr", listener.Addr(), "senders", r.opts.Senders)
+	events := make(chan senderEvent)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go r.readSender(conn, events, stop)
+		}
+	}()
+
+	var senders []*sender
+	finished, left := 0, 0
+	for r.opts.Senders == 0 || finished < r.opts.Senders {
+		var event senderEvent
+		select {
+		case event = <-events:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		s, line := event.sender, event.line
+		switch {
+		case event.err != nil:
+			if s.config != nil && s.done == nil {
+				r.log.Warn("sender left before sending its results", "sender", s.name, "err", event.err)
+				left++
+			}
+		case line.Hello != nil:
+			s.name, s.config = line.Hello.Sender, &line.Hello.Config
+			senders = append(senders, s)
+			r.log.Info("sender joined", "sender", s.name)
+		case s.config == nil:
+			// results without a hello first aren't from a sender
+		case line.Connection != nil:
+			s.results = append(s.results, line.Connection.statistics())
+		case line.Done != nil:
+			s.done = line.Done
+			finished++
+			r.log.Info("sender done", "sender", s.name, "connections", len(s.results), "finished", finished)
+		}
+	}
+
+	// without Config.Senders an interrupt is how the aggregator is stopped
+	return r.mergeSenders(senders, left, ctx.Err() != nil && r.opts.Senders > 0)
+}
+
+// readSender passes on the lines of a sender till it disconnects or stop is
+// closed
+func (r *Runner) readSender(conn net.Conn, events chan senderEvent, stop chan struct{}) {
+	defer conn.Close()
+	s := &sender{name: conn.RemoteAddr().String()}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, maxSinkLine)
+	emit := func(event senderEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	for scanner.Scan() {
+		var line sinkLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			emit(senderEvent{sender: s, err: fmt.Errorf("bad line: %v", err)})
+			return
+		}
+
+		if !emit(senderEvent{sender: s, line: line}) {
+			return
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("disconnected")
+	}
+
+	emit(senderEvent{sender: s, err: err})
+}
+
+// mergeSenders reports the connections of every sender as one run, with the
+// config of the first sender done. left is the number of senders which left
+// without their results. The breakdowns of Config.SharedGroup and
+// Config.FanIn are only in the senders' own reports
+func (r *Runner) mergeSenders(senders []*sender, left int, interrupted bool) (*Report, error) {
+	var config *Config
+	var results []Statistics
+	errors := make(map[string]int)
+	aggregate := newAggregate()
+	aggregate.interrupted = interrupted
+	// senders on the same topics publish to the same ones again, so the
+	// topics are the union of the senders'
+	published := make(map[string]bool)
+	running := 0
+	for _, s := range senders {
+		if s.done == nil {
+			running++
+			continue
+		}
+
+		if config == nil {
+			config = s.config
+		}
+
+		results = append(results, s.results...)
+		for i := range s.results {
+			if s.results[i].role.publishes() {
+				for _, topic := range subtopics(s.results[i].topic, s.config.Topics) {
+					published[topic] = true
+				}
+			}
+		}
+
+		for kind, n := range s.done.Errors {
+			errors[kind] += n
+		}
+
+		aggregate.failed += s.done.Failed
+		aggregate.interrupted = aggregate.interrupted || s.done.Interrupted
+		aggregate.concurrency += s.done.Concurrency
+		aggregate.aliasSaved += s.done.AliasSaved
+		aggregate.aliasTopics += s.done.AliasTopics
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("none of the %v senders sent results", len(senders))
+	}
+
+	for _, s := range results {
+		aggregate.add(s)
+	}
+
+	aggregate.topics = len(published)
+
+	opts := *config
+	opts.Output, opts.Csv, opts.Logger = r.opts.Output, r.opts.Csv, r.log
+	verified := !opts.VerifyQos2 || r.verify(results)
+	report := newReport(opts, results, &aggregate, verified, errors)
+	if burst, err := parseBurst(opts.Burst); err == nil && opts.Burst != "" {
+		report.Burst = newBurstReport(burst, aggregate.bursts)
+	}
+
+	if opts.ConsumeDelay > 0 {
+		report.Consume = newConsumeReport(&opts, results, &aggregate, errors)
+	}
+
+	// running includes the ones which left
+	if running > 0 {
+		report.Violations = append(report.Violations, fmt.Sprintf("%v of %v senders didn't send their results, %v of them left", running, len(senders), left))
+	}
+
+	return report, nil
+}
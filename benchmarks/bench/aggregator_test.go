@@ -0,0 +1,127 @@
+package bench
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSender is a sender done with a publisher and a subscriber on topic
+func testSender(name, topic string, topics int, latency time.Duration) *sender {
+	config := DefaultConfig()
+	config.Topics = topics
+	start := time.Unix(1000, 0)
+	latencies := new(histogram)
+	latencies.record(latency)
+	return &sender{
+		name:   name,
+		config: &config,
+		results: []Statistics{
+			{id: name + "-0", role: publisher, topic: topic, sent: 10, start: start, timeTaken: time.Second},
+			{id: name + "-1", role: subscriber, topic: topic, received: 10, start: start, timeTaken: time.Second, latencies: latencies, minLatency: latency, maxLatency: latency, avgLatency: latency},
+		},
+		done: &sinkDone{Failed: 1, Concurrency: 2, Errors: map[string]int{publishFailed: 1}},
+	}
+}
+
+func TestMergeSenders(t *testing.T) {
+	r := &Runner{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tests := []struct {
+		name        string
+		senders     []*sender
+		wantTopics  int
+		wantMissing int
+		wantErr     bool
+	}{
+		{
+			name:       "one sender",
+			senders:    []*sender{testSender("a", "t1", 1, time.Millisecond)},
+			wantTopics: 1,
+		},
+		{
+			name:       "different topics",
+			senders:    []*sender{testSender("a", "t1", 1, time.Millisecond), testSender("b", "t2", 1, 2*time.Millisecond)},
+			wantTopics: 2,
+		},
+		{
+			name:       "the same topics",
+			senders:    []*sender{testSender("a", "t1", 3, time.Millisecond), testSender("b", "t1", 3, time.Millisecond), testSender("c", "t2", 1, time.Millisecond)},
+			wantTopics: 4,
+		},
+		{
+			name:        "a sender left",
+			senders:     []*sender{testSender("a", "t1", 1, time.Millisecond), {name: "b", config: new(Config)}},
+			wantTopics:  1,
+			wantMissing: 1,
+		},
+		{
+			name:    "no results",
+			senders: []*sender{{name: "a", config: new(Config)}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := r.mergeSenders(test.senders, 0, false)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("mergeSenders() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			done := 0
+			for _, s := range test.senders {
+				if s.done != nil {
+					done++
+				}
+			}
+
+			aggregate := report.Aggregate
+			if aggregate.Connections != 2*done || aggregate.Sent != 10*done || aggregate.Received != 10*done {
+				t.Errorf("merged %v connections, %v sent and %v received, want the %v of %v senders", aggregate.Connections, aggregate.Sent, aggregate.Received, 2*done, done)
+			}
+
+			if aggregate.Topics != test.wantTopics {
+				t.Errorf("topics = %v, want %v", aggregate.Topics, test.wantTopics)
+			}
+
+			if aggregate.FailedConnections != done || aggregate.Concurrency != 2*done || report.Errors[publishFailed] != done {
+				t.Errorf("failed = %v, concurrency = %v, errors = %v, want the sum over %v senders", aggregate.FailedConnections, aggregate.Concurrency, report.Errors, done)
+			}
+
+			// the histograms of every sender are merged
+			if got := report.aggregate.latencies.count(); got != uint64(done) {
+				t.Errorf("merged %v latencies, want %v", got, done)
+			}
+
+			// besides the failed connections of the senders
+			missing := 0
+			for _, violation := range report.Violations {
+				if strings.Contains(violation, "senders didn't send their results") {
+					missing++
+				}
+			}
+
+			if missing != test.wantMissing {
+				t.Errorf("violations = %v, want %v for the senders without results", report.Violations, test.wantMissing)
+			}
+		})
+	}
+}
+
+func TestMergeSendersInterrupted(t *testing.T) {
+	r := &Runner{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	report, err := r.mergeSenders([]*sender{testSender("a", "t1", 1, time.Millisecond)}, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Aggregate.Interrupted {
+		t.Error("the report of an interrupted aggregator isn't interrupted")
+	}
+}
@@ -0,0 +1,62 @@
+package bench
+
+import (
+	"sync/atomic"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// aliasProperty is the size of a topic alias property, its identifier and
+// the alias
+const aliasProperty = 3
+
+// topicAliases gives the topics of an mqtt 5 connection aliases, up to what
+// the broker allows, for Config.TopicAlias. A topic is published in full with
+// its alias the first time and with only the alias after that. Used from
+// the publishing goroutine only
+type topicAliases struct {
+	aliases map[string]uint16
+	maximum uint16
+	bytes   *aliasBytes
+}
+
+// aliasBytes tallies what topic aliases saved during a run
+type aliasBytes struct {
+	// saved is the topic bytes left out, less the alias properties sent
+	saved atomic.Int64
+	// topics is the topic bytes which would have been sent without aliases
+	topics atomic.Int64
+}
+
+func newTopicAliases(maximum uint16, bytes *aliasBytes) *topicAliases {
+	return &topicAliases{aliases: make(map[string]uint16), maximum: maximum, bytes: bytes}
+}
+
+// apply sets the alias of publish, and leaves its topic out once the broker
+// knows the alias
+func (a *topicAliases) apply(publish *paho.Publish) {
+	topic := publish.Topic
+	a.bytes.topics.Add(int64(len(topic)))
+	alias, known := a.aliases[topic]
+	if !known {
+		if len(a.aliases) >= int(a.maximum) {
+			return
+		}
+
+		alias = uint16(len(a.aliases) + 1)
+		a.aliases[topic] = alias
+	}
+
+	if publish.Properties == nil {
+		publish.Properties = new(paho.PublishProperties)
+	}
+
+	publish.Properties.TopicAlias = &alias
+	if !known {
+		a.bytes.saved.Add(-aliasProperty)
+		return
+	}
+
+	publish.Topic = ""
+	a.bytes.saved.Add(int64(len(topic) - aliasProperty))
+}
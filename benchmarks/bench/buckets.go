@@ -0,0 +1,91 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BucketReport is the number of latencies from MinMillis up to MaxMillis, for
+// Config.Buckets. The last bucket has no MaxMillis
+type BucketReport struct {
+	MinMillis float64 `json:"min_ms"`
+	MaxMillis float64 `json:"max_ms,omitempty"`
+	Count     uint64  `json:"count"`
+}
+
+// parseBuckets parses increasing millisecond bounds like 1,5,10,50, nil for
+// none
+func parseBuckets(s string) ([]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var bounds []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		ms, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("latency-buckets should be positive milliseconds, like 1,5,10,50. Found %q", s)
+		}
+
+		bound := time.Duration(ms * float64(time.Millisecond))
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("latency-buckets should be increasing. Found %q", s)
+		}
+
+		bounds = append(bounds, bound)
+	}
+
+	return bounds, nil
+}
+
+// bucketReports counts the latencies of h between the bounds, with a bucket
+// below the first and one above the last
+func bucketReports(h *histogram, bounds []time.Duration) []BucketReport {
+	reports := make([]BucketReport, 0, len(bounds)+1)
+	var lower time.Duration
+	var below uint64
+	for _, bound := range bounds {
+		n := h.below(bound)
+		reports = append(reports, BucketReport{MinMillis: millis(lower), MaxMillis: millis(bound), Count: n - below})
+		lower, below = bound, n
+	}
+
+	return append(reports, BucketReport{MinMillis: millis(lower), Count: h.count() - below})
+}
+
+// column is the csv header of the bucket, like latency_1_5_ms
+func (b BucketReport) column() string {
+	if b.MaxMillis == 0 {
+		return fmt.Sprintf("latency_%v_inf_ms", b.MinMillis)
+	}
+
+	return fmt.Sprintf("latency_%v_%v_ms", b.MinMillis, b.MaxMillis)
+}
+
+// writeBuckets writes a bar per bucket, the longest one for the fullest
+func writeBuckets(w io.Writer, buckets []BucketReport) {
+	const width = 40
+	var most uint64
+	for _, b := range buckets {
+		most = max(most, b.Count)
+	}
+
+	fmt.Fprintln(w, "Latency histogram:")
+	for i, b := range buckets {
+		label := fmt.Sprintf("%vms - %vms", b.MinMillis, b.MaxMillis)
+		if i == len(buckets)-1 {
+			label = fmt.Sprintf("%vms and above", b.MinMillis)
+		}
+
+		bar := 0
+		if most > 0 {
+			bar = int(b.Count * width / most)
+		}
+
+		line := fmt.Sprintf("    %-20v %10v %v", label, b.Count, strings.Repeat("#", bar))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
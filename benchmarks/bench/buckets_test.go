@@ -0,0 +1,112 @@
+package bench
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "1,5,10", want: []time.Duration{time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond}},
+		{s: "0.5, 2", want: []time.Duration{500 * time.Microsecond, 2 * time.Millisecond}},
+		{s: "1,x", wantErr: true},
+		{s: "0,1", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "5,1", wantErr: true},
+		{s: "1,1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseBuckets(test.s)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseBuckets(%q) error = %v, want error %v", test.s, err, test.wantErr)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBuckets(%q) = %v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestBucketReports(t *testing.T) {
+	h := new(histogram)
+	for _, d := range []time.Duration{500 * time.Microsecond, 2 * time.Millisecond, 3 * time.Millisecond, 7 * time.Millisecond, time.Second} {
+		h.record(d)
+	}
+
+	bounds, err := parseBuckets("1,5,10,50")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BucketReport{
+		{MinMillis: 0, MaxMillis: 1, Count: 1},
+		{MinMillis: 1, MaxMillis: 5, Count: 2},
+		{MinMillis: 5, MaxMillis: 10, Count: 1},
+		{MinMillis: 10, MaxMillis: 50, Count: 0},
+		{MinMillis: 50, Count: 1},
+	}
+
+	if got := bucketReports(h, bounds); !reflect.DeepEqual(got, want) {
+		t.Errorf("bucketReports() = %v, want %v", got, want)
+	}
+
+	// subscribers without latencies still get every bucket
+	if got := bucketReports(nil, bounds); len(got) != len(want) || got[len(got)-1].Count != 0 {
+		t.Errorf("bucketReports(nil) = %v, want %v empty buckets", got, len(want))
+	}
+}
+
+func TestBucketColumn(t *testing.T) {
+	tests := []struct {
+		bucket BucketReport
+		want   string
+	}{
+		{BucketReport{MinMillis: 0, MaxMillis: 1}, "latency_0_1_ms"},
+		{BucketReport{MinMillis: 1, MaxMillis: 5}, "latency_1_5_ms"},
+		{BucketReport{MinMillis: 0.5, MaxMillis: 2.5}, "latency_0.5_2.5_ms"},
+		{BucketReport{MinMillis: 50}, "latency_50_inf_ms"},
+	}
+
+	for _, test := range tests {
+		if got := test.bucket.column(); got != test.want {
+			t.Errorf("column() of %+v = %q, want %q", test.bucket, got, test.want)
+		}
+	}
+}
+
+func TestAppendCSVColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	report := func(buckets string) *Report {
+		return &Report{opts: Config{Buckets: buckets}, results: []Statistics{{id: "a", sent: 1, timeTaken: time.Second}}}
+	}
+
+	for _, buckets := range []string{"1,5", "1,5"} {
+		if err := report(buckets).AppendCSV(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := report("1,10").AppendCSV(path); err == nil {
+		t.Error("appended to a file with other bucket columns")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("%v lines, want the header and two rows:\n%s", lines, data)
+	}
+}
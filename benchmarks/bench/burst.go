@@ -0,0 +1,277 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// burstSlices is the number of slices of a Config.Burst cycle the
+	// latencies are followed over, the precision of the recovery time
+	burstSlices = 20
+	// recoveryFactor is how far above the p99 before a burst the p99 of a
+	// slice after it can be and count as recovered
+	recoveryFactor = 1.5
+)
+
+// schedule is the parsed form of Config.Burst, phases of a rate which repeat
+// every period
+type schedule struct {
+	phases []burstPhase
+	period time.Duration
+	// perCycle is the number of messages due in a period
+	perCycle float64
+}
+
+type burstPhase struct {
+	length time.Duration
+	rate   float64
+}
+
+// parseBurst parses phases like 100ms@10000,900ms@100, a length at a rate in
+// messages per second each
+func parseBurst(s string) (*schedule, error) {
+	sched := new(schedule)
+	for _, field := range strings.Split(s, ",") {
+		length, rate, found := strings.Cut(strings.TrimSpace(field), "@")
+		if !found {
+			return nil, fmt.Errorf("burst should be phases of a length at a rate, like 100ms@10000,900ms@100. Found %q", s)
+		}
+
+		var phase burstPhase
+		var err error
+		if phase.length, err = time.ParseDuration(length); err != nil || phase.length <= 0 {
+			return nil, fmt.Errorf("burst phase %q should have a positive length", field)
+		}
+
+		if phase.rate, err = strconv.ParseFloat(rate, 64); err != nil || phase.rate < 0 {
+			return nil, fmt.Errorf("burst phase %q should have a rate of 0 or more messages per second", field)
+		}
+
+		sched.phases = append(sched.phases, phase)
+		sched.period += phase.length
+		sched.perCycle += phase.length.Seconds() * phase.rate
+	}
+
+	if sched.perCycle == 0 {
+		return nil, fmt.Errorf("burst %q never publishes", s)
+	}
+
+	return sched, nil
+}
+
+// average is the messages per second over a cycle
+func (s *schedule) average() float64 {
+	return s.perCycle / s.period.Seconds()
+}
+
+// at is how long after the start of a cycle the nth message from then is due
+func (s *schedule) at(n float64) time.Duration {
+	cycles := math.Floor(n / s.perCycle)
+	n -= cycles * s.perCycle
+	offset := time.Duration(cycles) * s.period
+	for _, phase := range s.phases {
+		count := phase.length.Seconds() * phase.rate
+		if n < count {
+			return offset + time.Duration(n/phase.rate*float64(time.Second))
+		}
+
+		n -= count
+		offset += phase.length
+	}
+
+	// rounding at the end of the cycle
+	return offset
+}
+
+// count is the number of messages due by offset into a cycle
+func (s *schedule) count(offset time.Duration) float64 {
+	n := 0.0
+	for _, phase := range s.phases {
+		if offset < phase.length {
+			return n + offset.Seconds()*phase.rate
+		}
+
+		n += phase.length.Seconds() * phase.rate
+		offset -= phase.length
+	}
+
+	return n
+}
+
+// offset is how far into its cycle a message sent at the given time is, with
+// the cycles counted from epoch
+func (s *schedule) offset(epoch, at time.Time) time.Duration {
+	return (at.Sub(epoch)%s.period + s.period) % s.period
+}
+
+// phase is the index of the phase at offset into a cycle
+func (s *schedule) phase(offset time.Duration) int {
+	for i, phase := range s.phases {
+		if offset < phase.length {
+			return i
+		}
+
+		offset -= phase.length
+	}
+
+	return len(s.phases) - 1
+}
+
+// burst is the index of the phase with the highest rate, the first one of
+// them on a tie, and when it starts in a cycle
+func (s *schedule) burst() (int, time.Duration) {
+	burst, start := 0, time.Duration(0)
+	var at time.Duration
+	for i, phase := range s.phases {
+		if phase.rate > s.phases[burst].rate {
+			burst, start = i, at
+		}
+
+		at += phase.length
+	}
+
+	return burst, start
+}
+
+// newBurstLimiter paces messages by s, in step with the cycles from epoch so
+// that the connections burst together however late they start
+func newBurstLimiter(s *schedule, epoch time.Time) *limiter {
+	now := time.Now()
+	offset := s.offset(epoch, now)
+	return &limiter{start: now.Add(-offset), schedule: s, base: s.count(offset)}
+}
+
+// messageLimiter paces the messages of a connection by Config.Rate, or by
+// Config.Burst
+func (r *Runner) messageLimiter() *limiter {
+	if r.burst != nil {
+		return newBurstLimiter(r.burst, r.measureStart())
+	}
+
+	return newLimiter(r.opts.Rate)
+}
+
+// burstLatencies holds the latencies of the messages received by the phase of
+// the cycle and the slice of it they were sent in
+type burstLatencies struct {
+	phases []histogram
+	slices []histogram
+}
+
+func newBurstLatencies(phases int) *burstLatencies {
+	return &burstLatencies{phases: make([]histogram, phases), slices: make([]histogram, burstSlices)}
+}
+
+func (b *burstLatencies) record(s *schedule, offset, latency time.Duration) {
+	b.phases[s.phase(offset)].record(latency)
+	b.slices[int(offset*burstSlices/s.period)].record(latency)
+}
+
+func (b *burstLatencies) merge(other *burstLatencies) {
+	for i := range b.phases {
+		b.phases[i].merge(&other.phases[i])
+	}
+
+	for i := range b.slices {
+		b.slices[i].merge(&other.slices[i])
+	}
+}
+
+// BurstReport follows the latencies through the cycles of Config.Burst, by
+// the time in the cycle the messages were sent
+type BurstReport struct {
+	PeriodMillis float64            `json:"period_ms"`
+	Phases       []BurstPhaseReport `json:"phases"`
+	Timeline     []BurstSliceReport `json:"timeline"`
+	// RecoveryMillis is the time from the end of the burst, the phase of the
+	// highest rate, till the p99 latency of a slice is back within
+	// recoveryFactor of the p99 of the slice before the burst. Recovered is
+	// false when it doesn't get back before the next burst
+	RecoveryMillis float64 `json:"recovery_ms"`
+	Recovered      bool    `json:"recovered"`
+}
+
+type BurstPhaseReport struct {
+	LengthMillis float64           `json:"length_ms"`
+	Rate         float64           `json:"rate"`
+	Received     uint64            `json:"received"`
+	Latency      *PercentileReport `json:"latency"`
+}
+
+// BurstSliceReport is the latencies of the messages sent from OffsetMillis
+// into a cycle, for a twentieth of it
+type BurstSliceReport struct {
+	OffsetMillis float64           `json:"offset_ms"`
+	Received     uint64            `json:"received"`
+	Latency      *PercentileReport `json:"latency"`
+}
+
+func newBurstReport(s *schedule, b *burstLatencies) *BurstReport {
+	if b == nil {
+		b = newBurstLatencies(len(s.phases))
+	}
+
+	report := &BurstReport{PeriodMillis: millis(s.period)}
+	for i, phase := range s.phases {
+		h := &b.phases[i]
+		report.Phases = append(report.Phases, BurstPhaseReport{LengthMillis: millis(phase.length), Rate: phase.rate, Received: h.total, Latency: percentiles(h)})
+	}
+
+	width := s.period / burstSlices
+	for i := range b.slices {
+		h := &b.slices[i]
+		report.Timeline = append(report.Timeline, BurstSliceReport{OffsetMillis: millis(time.Duration(i) * width), Received: h.total, Latency: percentiles(h)})
+	}
+
+	// from the first slice sent after the burst up to the one before the
+	// next, which is the baseline
+	burst, start := s.burst()
+	end := start + s.phases[burst].length
+	baseline := &b.slices[(int(start/width)+burstSlices-1)%burstSlices]
+	if baseline.total == 0 {
+		return report
+	}
+
+	threshold := time.Duration(float64(baseline.percentile(99)) * recoveryFactor)
+	first := int((end + width - 1) / width)
+	for k := first; k < first+burstSlices; k++ {
+		h := &b.slices[k%burstSlices]
+		if h == baseline {
+			break
+		}
+
+		if h.total > 0 && h.percentile(99) <= threshold {
+			report.RecoveryMillis, report.Recovered = millis(time.Duration(k)*width-end), true
+			break
+		}
+	}
+
+	return report
+}
+
+// write writes the recovery and the latencies of each phase
+func (b *BurstReport) write(w io.Writer) {
+	recovery := "not recovered before the next burst"
+	if b.Recovered {
+		recovery = fmt.Sprint(fromMillis(b.RecoveryMillis).Round(time.Millisecond), " after the burst")
+	}
+
+	fmt.Fprintln(w, "Burst: Period =", fromMillis(b.PeriodMillis), ", Recovery =", recovery)
+	for _, phase := range b.Phases {
+		l := phase.Latency
+		fmt.Fprintln(w, "   ", fromMillis(phase.LengthMillis), "at", phase.Rate, "messages/sec: Received =", phase.Received, ", Latency (p50/p95/p99) =", fromMicros(l.P50Micros), "/", fromMicros(l.P95Micros), "/", fromMicros(l.P99Micros))
+	}
+}
+
+func fromMillis(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func fromMicros(us float64) time.Duration {
+	return time.Duration(us * float64(time.Microsecond))
+}
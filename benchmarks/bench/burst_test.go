@@ -0,0 +1,215 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBurst(t *testing.T) {
+	tests := []struct {
+		s            string
+		wantPeriod   time.Duration
+		wantPerCycle float64
+		wantErr      bool
+	}{
+		{s: "100ms@1000,900ms@100", wantPeriod: time.Second, wantPerCycle: 190},
+		{s: "1s@10", wantPeriod: time.Second, wantPerCycle: 10},
+		{s: " 500ms@0 , 500ms@20", wantPeriod: time.Second, wantPerCycle: 10},
+		{s: "100ms", wantErr: true},
+		{s: "0s@10", wantErr: true},
+		{s: "100ms@-1", wantErr: true},
+		{s: "100ms@x", wantErr: true},
+		{s: "100ms@0,1s@0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseBurst(test.s)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseBurst(%q) error = %v, want error %v", test.s, err, test.wantErr)
+			continue
+		}
+
+		if err == nil && (got.period != test.wantPeriod || got.perCycle != test.wantPerCycle) {
+			t.Errorf("parseBurst(%q) = period %v, %v per cycle, want %v and %v", test.s, got.period, got.perCycle, test.wantPeriod, test.wantPerCycle)
+		}
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	s, err := parseBurst("100ms@1000,900ms@100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		n    float64
+		want time.Duration
+	}{
+		{0, 0},
+		{50, 50 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+		{101, 110 * time.Millisecond},
+		{189, 990 * time.Millisecond},
+		// the next cycles
+		{190, time.Second},
+		{240, 1050 * time.Millisecond},
+		{390, 2010 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		if got := s.at(test.n); got != test.want {
+			t.Errorf("at(%v) = %v, want %v", test.n, got, test.want)
+		}
+	}
+
+	if got := s.average(); got != 190 {
+		t.Errorf("average() = %v, want 190", got)
+	}
+}
+
+func TestScheduleCount(t *testing.T) {
+	s, err := parseBurst("100ms@1000,900ms@100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset time.Duration
+		want   float64
+	}{
+		{0, 0},
+		{50 * time.Millisecond, 50},
+		{100 * time.Millisecond, 100},
+		{200 * time.Millisecond, 110},
+		{time.Second, 190},
+	}
+
+	for _, test := range tests {
+		if got := s.count(test.offset); got != test.want {
+			t.Errorf("count(%v) = %v, want %v", test.offset, got, test.want)
+		}
+
+		// count is the inverse of at within a cycle
+		if test.offset < s.period {
+			if got := s.at(test.want); got != test.offset {
+				t.Errorf("at(count(%v)) = %v", test.offset, got)
+			}
+		}
+	}
+}
+
+func TestScheduleOffsetAndPhase(t *testing.T) {
+	s, err := parseBurst("100ms@1000,900ms@100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(1000, 0)
+	tests := []struct {
+		at         time.Time
+		wantOffset time.Duration
+		wantPhase  int
+	}{
+		{epoch, 0, 0},
+		{epoch.Add(50 * time.Millisecond), 50 * time.Millisecond, 0},
+		{epoch.Add(100 * time.Millisecond), 100 * time.Millisecond, 1},
+		{epoch.Add(2300 * time.Millisecond), 300 * time.Millisecond, 1},
+		// messages sent before the epoch, in the warmup
+		{epoch.Add(-200 * time.Millisecond), 800 * time.Millisecond, 1},
+		{epoch.Add(-950 * time.Millisecond), 50 * time.Millisecond, 0},
+	}
+
+	for _, test := range tests {
+		offset := s.offset(epoch, test.at)
+		if offset != test.wantOffset {
+			t.Errorf("offset(%v) = %v, want %v", test.at.Sub(epoch), offset, test.wantOffset)
+		}
+
+		if got := s.phase(offset); got != test.wantPhase {
+			t.Errorf("phase(%v) = %v, want %v", offset, got, test.wantPhase)
+		}
+	}
+}
+
+func TestScheduleBurst(t *testing.T) {
+	tests := []struct {
+		s         string
+		wantPhase int
+		wantStart time.Duration
+	}{
+		{"100ms@1000,900ms@100", 0, 0},
+		{"900ms@100,100ms@1000", 1, 900 * time.Millisecond},
+		{"200ms@10,300ms@500,500ms@500", 1, 200 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		s, err := parseBurst(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if phase, start := s.burst(); phase != test.wantPhase || start != test.wantStart {
+			t.Errorf("burst() of %q = %v at %v, want %v at %v", test.s, phase, start, test.wantPhase, test.wantStart)
+		}
+	}
+}
+
+func TestBurstRecovery(t *testing.T) {
+	s, err := parseBurst("100ms@1000,900ms@100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// slices are 50ms. The burst is the first two, and the latencies recover
+	// in the fifth, 100ms after it ends
+	b := newBurstLatencies(len(s.phases))
+	record := func(offset, latency time.Duration) {
+		b.record(s, offset, latency)
+	}
+
+	record(975*time.Millisecond, time.Millisecond)
+	for offset := time.Duration(0); offset < 200*time.Millisecond; offset += 10 * time.Millisecond {
+		record(offset, 10*time.Millisecond)
+	}
+
+	record(210*time.Millisecond, time.Millisecond)
+	report := newBurstReport(s, b)
+	if !report.Recovered || report.RecoveryMillis != 100 {
+		t.Errorf("recovery = %v ms, recovered %v, want 100ms", report.RecoveryMillis, report.Recovered)
+	}
+
+	if got := report.Phases[0].Received; got != 10 {
+		t.Errorf("burst phase received %v, want 10", got)
+	}
+
+	if len(report.Timeline) != burstSlices {
+		t.Errorf("timeline has %v slices, want %v", len(report.Timeline), burstSlices)
+	}
+
+	// without recovering before the next burst
+	b = newBurstLatencies(len(s.phases))
+	record(975*time.Millisecond, time.Millisecond)
+	record(500*time.Millisecond, 10*time.Millisecond)
+	if report := newBurstReport(s, b); report.Recovered {
+		t.Errorf("recovered %v ms after the burst, want not recovered", report.RecoveryMillis)
+	}
+}
+
+func TestBurstLimiter(t *testing.T) {
+	s, err := parseBurst("100ms@1000,900ms@100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a connection starting 2.05s into the run is 50ms into a cycle, with 50
+	// messages of the cycle gone
+	epoch := time.Now().Add(-2050 * time.Millisecond)
+	l := newBurstLimiter(s, epoch)
+	if l.base < 49 || l.base > 51 {
+		t.Errorf("base = %v, want about 50", l.base)
+	}
+
+	if offset := s.offset(epoch, l.start); offset != 0 {
+		t.Errorf("limiter starts %v into a cycle, want the start of one", offset)
+	}
+}
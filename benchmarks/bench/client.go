@@ -0,0 +1,659 @@
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/websocket"
+)
+
+// client hides the mqtt library behind the few operations the benchmark
+// needs, so that 3.1/3.1.1 connections (paho.mqtt.golang) and 5 connections
+// (paho.golang) are driven by the same code. Publish and Subscribe block till
+// the broker acknowledges them
+type client interface {
+	// Subscribe calls handler with the mqtt 5 request properties of each
+	// message, nil without any. A nil handler ignores the messages
+	Subscribe(topic string, qos byte, handler func(topic string, payload []byte, req *request)) error
+	Unsubscribe(topic string) error
+	// Publish calls sent once the client has sent the message, before it
+	// waits for the acknowledgement
+	Publish(topic string, qos byte, retain bool, payload []byte, sent func()) error
+	// PublishAsync returns once the message is sent and calls done with the
+	// outcome when the broker acknowledges it. Messages are sent in the order
+	// they are published. payload must not be changed till done is called
+	PublishAsync(topic string, qos byte, retain bool, payload []byte, done func(error))
+	Disconnect()
+	// Kill closes the network connection without a disconnect, like a crash
+	// would. Only for clients connected with a will
+	Kill()
+	// Connack is what the broker answered the connect with
+	Connack() connack
+}
+
+// connack is the outcome of a connect the broker accepted. Refusals are
+// connect errors with the reason code
+type connack struct {
+	// sessionPresent is whether the broker resumed a session of the client id
+	sessionPresent bool
+	// assignedID is the client id an mqtt 5 broker assigned, empty when it
+	// kept the one connected with
+	assignedID string
+}
+
+// request is the response topic and correlation data of an mqtt 5 message,
+// for Config.RoundTrip. Replies only have the correlation data
+type request struct {
+	responseTopic string
+	correlation   []byte
+}
+
+// responder is implemented by the clients which can reply to requests, mqtt 5
+// ones
+type responder interface {
+	// Respond publishes payload to the response topic of req with its
+	// correlation data. At QoS 0, so that the message handler replying never
+	// waits on an ack
+	Respond(req *request, payload []byte) error
+}
+
+// will is the message the broker publishes when the client dies
+type will struct {
+	topic   string
+	payload []byte
+}
+
+// connect opens a client. will is optional
+func (r *Runner) connect(id, broker string, will *will) (client, error) {
+	if r.opts.MqttVersion == 5 {
+		return r.connect5(id, broker, will)
+	}
+
+	return r.connect3(id, broker, will)
+}
+
+// client3 speaks mqtt 3.1 and 3.1.1
+type client3 struct {
+	mqtt.Client
+	metrics *metrics
+	// conn is the network connection of clients with a will, for Kill
+	conn *net.Conn
+	ack  connack
+}
+
+func (r *Runner) connect3(id, broker string, will *will) (client, error) {
+	options := mqtt.NewClientOptions().AddBroker(broker)
+	options.SetClientID(id)
+	options.SetProtocolVersion(uint(r.opts.MqttVersion))
+	options.SetCleanSession(r.opts.CleanSession)
+	options.SetKeepAlive(r.opts.KeepAlive)
+	options.SetMaxResumePubInFlight(r.opts.MaxInflight)
+	options.SetStore(r.store3(id))
+	options.SetHTTPHeaders(r.wsHeaders)
+	if r.tlsConfig != nil {
+		options.SetTLSConfig(r.tlsConfig)
+	}
+
+	if r.opts.Username != "" {
+		options.SetUsername(r.opts.Username)
+	}
+
+	if r.opts.Password != "" {
+		options.SetPassword(r.opts.Password)
+	}
+
+	options.SetOnConnectHandler(func(client mqtt.Client) {
+		atomic.AddInt64(&r.metrics.active, 1)
+	})
+
+	// the connection is opened here for clients with a will, to Kill,
+	// through Config.Proxy or Config.LocalAddr and without Config.NoDelay
+	var conn *net.Conn
+	if will != nil || r.opts.Proxy != "" || len(r.opts.LocalAddr) > 0 || !r.opts.NoDelay {
+		conn = new(net.Conn)
+		options.SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			c, err := r.dial(uri.String())
+			*conn = c
+			return c, err
+		})
+	}
+
+	if will != nil {
+		options.SetBinaryWill(will.topic, will.payload, byte(r.opts.PubQos), false)
+		options.SetAutoReconnect(false)
+	}
+
+	options.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		atomic.AddInt64(&r.metrics.active, -1)
+		if will != nil {
+			// killed on purpose
+			return
+		}
+
+		r.fail(id, disconnected, err)
+		if pingTimedOut(err) {
+			r.log.Warn("connection lost, the broker didn't answer a keep alive ping", "id", id)
+			return
+		}
+
+		// mqtt 3 brokers close the connection without a reason on a session
+		// takeover
+		r.log.Warn("connection lost, another client with the same id may have taken over the session", "id", id, "err", err)
+	})
+
+	c := mqtt.NewClient(options)
+	token := c.Connect()
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	ack := connack{sessionPresent: token.(*mqtt.ConnectToken).SessionPresent()}
+	return client3{c, r.metrics, conn, ack}, nil
+}
+
+func (c client3) Subscribe(topic string, qos byte, handler func(topic string, payload []byte, req *request)) error {
+	var callback mqtt.MessageHandler
+	if handler != nil {
+		callback = func(client mqtt.Client, msg mqtt.Message) {
+			handler(msg.Topic(), msg.Payload(), nil)
+		}
+	}
+
+	token := c.Client.Subscribe(topic, qos, callback)
+	token.Wait()
+	return token.Error()
+}
+
+func (c client3) Unsubscribe(topic string) error {
+	token := c.Client.Unsubscribe(topic)
+	token.Wait()
+	return token.Error()
+}
+
+func (c client3) Publish(topic string, qos byte, retain bool, payload []byte, sent func()) error {
+	// paho.mqtt.golang queues the message for its writer, which is as close
+	// to sent as it tells
+	token := c.Client.Publish(topic, qos, retain, payload)
+	sent()
+	token.Wait()
+	return token.Error()
+}
+
+func (c client3) PublishAsync(topic string, qos byte, retain bool, payload []byte, done func(error)) {
+	token := c.Client.Publish(topic, qos, retain, payload)
+	go func() {
+		token.Wait()
+		done(token.Error())
+	}()
+}
+
+func (c client3) Connack() connack {
+	return c.ack
+}
+
+func (c client3) Kill() {
+	(*c.conn).Close()
+}
+
+func (c client3) Disconnect() {
+	// the connection lost handler is only called on errors
+	if c.IsConnectionOpen() {
+		atomic.AddInt64(&c.metrics.active, -1)
+	}
+
+	c.Client.Disconnect(250)
+}
+
+// sessionTakenOver is the mqtt 5 disconnect reason when another client
+// connects with the same id
+const sessionTakenOver = 0x8E
+
+// client5 speaks mqtt 5
+type client5 struct {
+	*paho.Client
+	// lost makes sure that a connection is only counted as lost once, as
+	// paho.golang can report multiple errors for one connection
+	lost    *sync.Once
+	metrics *metrics
+	conn    net.Conn
+	session *ackSession
+	// aliases is set with Config.TopicAlias
+	aliases *topicAliases
+	// responseTopic is where the replies to the client's requests go, with
+	// Config.RoundTrip
+	responseTopic string
+	ack           connack
+}
+
+// ackSession reports the acknowledgements of publishes sent by
+// client5.PublishAsync, which paho.golang doesn't for publishes it doesn't
+// block on
+type ackSession struct {
+	session.SessionManager
+	// next is called with the outcome of the next publish added to the
+	// session. Set by PublishAsync right before publishing
+	next func(error)
+}
+
+func (s *ackSession) AddToSession(ctx context.Context, packet session.Packet, resp chan<- packets.ControlPacket) error {
+	done := s.next
+	s.next = nil
+	if done == nil {
+		return s.SessionManager.AddToSession(ctx, packet, resp)
+	}
+
+	acked := make(chan packets.ControlPacket, 1)
+	if err := s.SessionManager.AddToSession(ctx, packet, acked); err != nil {
+		done(err)
+		return err
+	}
+
+	go func() {
+		ack := <-acked
+		// paho.golang waits on resp, which has room for the ack, only for
+		// blocking publishes
+		resp <- ack
+		if ack.Type == 0 {
+			// the session was closed before the ack arrived
+			done(errors.New("publish not acknowledged before disconnect"))
+			return
+		}
+
+		done(ackError(ack))
+	}()
+
+	return nil
+}
+
+// ackError is the error of an ack with a reason code of 0x80 or more, which
+// the broker refuses the publish with. nil for the rest
+func ackError(ack packets.ControlPacket) error {
+	var code byte
+	var reason string
+	switch p := ack.Content.(type) {
+	case *packets.Puback:
+		code, reason = p.ReasonCode, p.Reason()
+	case *packets.Pubrec:
+		code, reason = p.ReasonCode, p.Reason()
+	case *packets.Pubcomp:
+		code, reason = p.ReasonCode, p.Reason()
+	}
+
+	if code < 0x80 {
+		return nil
+	}
+
+	return fmt.Errorf("publish refused with reason code %#x: %v", code, reason)
+}
+
+func (r *Runner) connect5(id, broker string, will *will) (client, error) {
+	conn, err := r.dial(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionState, err := r.session5(id)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := client5{lost: new(sync.Once), metrics: r.metrics, conn: conn, session: &ackSession{SessionManager: sessionState}}
+	onLost := func(err error) {
+		c.lost.Do(func() {
+			atomic.AddInt64(&r.metrics.active, -1)
+			// clients with a will are killed on purpose
+			if will == nil {
+				r.fail(id, disconnected, err)
+			}
+		})
+	}
+
+	c.Client = paho.NewClient(paho.ClientConfig{
+		ClientID: id,
+		Conn:     packets.NewThreadSafeConn(conn),
+		Session:  c.session,
+		OnClientError: func(err error) {
+			onLost(err)
+			if pingTimedOut(err) {
+				r.log.Warn("connection lost, the broker didn't answer a keep alive ping", "id", id)
+				return
+			}
+
+			r.log.Debug("connection error", "id", id, "err", err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			onLost(fmt.Errorf("disconnected by the broker with reason code %#x", d.ReasonCode))
+			if d.ReasonCode == sessionTakenOver {
+				r.log.Warn("session taken over by another client with the same id", "id", id)
+				return
+			}
+
+			r.log.Debug("disconnected by the broker", "id", id, "reason", d.ReasonCode)
+		},
+	})
+
+	connect := &paho.Connect{
+		ClientID:     id,
+		KeepAlive:    uint16(r.opts.KeepAlive / time.Second),
+		CleanStart:   r.opts.CleanSession,
+		Username:     r.opts.Username,
+		UsernameFlag: r.opts.Username != "",
+		Password:     []byte(r.opts.Password),
+		PasswordFlag: r.opts.Password != "",
+	}
+
+	if will != nil {
+		connect.WillMessage = &paho.WillMessage{Topic: will.topic, Payload: will.payload, QoS: byte(r.opts.PubQos)}
+	}
+
+	if !r.opts.CleanSession || r.opts.MsgDepth > 0 {
+		connect.Properties = new(paho.ConnectProperties)
+	}
+
+	if !r.opts.CleanSession {
+		// mqtt 5 ends the session with the connection unless told otherwise
+		expiry := uint32(math.MaxUint32)
+		connect.Properties.SessionExpiryInterval = &expiry
+	}
+
+	if r.opts.MsgDepth > 0 {
+		// paho buffers as many received messages as the broker may send
+		// unacknowledged
+		depth := uint16(r.opts.MsgDepth)
+		connect.Properties.ReceiveMaximum = &depth
+	}
+
+	connack, err := c.Connect(context.Background(), connect)
+	if err != nil {
+		conn.Close()
+		// paho.golang only tells the reason string, which brokers may leave out
+		if connack != nil {
+			return nil, fmt.Errorf("refused with reason code %#x: %v", connack.ReasonCode, err)
+		}
+
+		return nil, err
+	}
+
+	c.ack.sessionPresent = connack.SessionPresent
+	if connack.Properties != nil {
+		c.ack.assignedID = connack.Properties.AssignedClientID
+	}
+
+	if r.opts.TopicAlias {
+		if connack.Properties == nil || connack.Properties.TopicAliasMaximum == nil || *connack.Properties.TopicAliasMaximum == 0 {
+			// not a lost connection
+			c.lost.Do(func() {})
+			c.Client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+			return nil, errors.New("the broker allows no topic aliases")
+		}
+
+		c.aliases = newTopicAliases(*connack.Properties.TopicAliasMaximum, &r.aliasBytes)
+	}
+
+	if r.opts.RoundTrip {
+		c.responseTopic = responseTopic(id)
+	}
+
+	atomic.AddInt64(&r.metrics.active, 1)
+	return c, nil
+}
+
+// responseTopic is the response topic of the requests of the client with the
+// given id
+func responseTopic(id string) string {
+	return id + "/response"
+}
+
+// dial opens the network connection for paho.golang, which leaves that to
+// the user, and for paho.mqtt.golang clients which need their connection.
+// Mirrors the schemes paho.mqtt.golang supports
+func (r *Runner) dial(broker string) (net.Conn, error) {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch uri.Scheme {
+	case "tcp":
+		return r.dialTCP(uri.Host)
+	case "ssl", "tls":
+		return r.dialTLS(uri.Host)
+	case "ws", "wss":
+		origin, host, port := "http://"+uri.Host, uri.Hostname(), "80"
+		if uri.Scheme == "wss" {
+			origin, port = "https://"+uri.Host, "443"
+		}
+
+		if uri.Port() != "" {
+			port = uri.Port()
+		}
+
+		config, err := websocket.NewConfig(uri.String(), origin)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Protocol = []string{"mqtt"}
+		config.Header = r.wsHeaders
+		var conn net.Conn
+		if uri.Scheme == "wss" {
+			conn, err = r.dialTLS(net.JoinHostPort(host, port))
+		} else {
+			conn, err = r.dialTCP(net.JoinHostPort(host, port))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		ws, err := websocket.NewClient(config, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+		ws.PayloadType = websocket.BinaryFrame
+		return ws, nil
+	}
+
+	return nil, fmt.Errorf("unsupported scheme %v", uri.Scheme)
+}
+
+// dialTCP opens a tcp connection to host, with Nagle's algorithm off unless
+// Config.NoDelay is false. Connections through a proxy which doesn't expose
+// its tcp connection keep the proxy's setting
+func (r *Runner) dialTCP(host string) (net.Conn, error) {
+	conn, err := r.dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcp, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		if err := tcp.SetNoDelay(r.opts.NoDelay); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// dialTLS opens a tls connection to host, verifying the broker under its
+// host name unless the tls options say otherwise
+func (r *Runner) dialTLS(host string) (net.Conn, error) {
+	conn, err := r.dialTCP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(tls.Config)
+	if r.tlsConfig != nil {
+		config = r.tlsConfig.Clone()
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			config.ServerName = name
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (c client5) Subscribe(topic string, qos byte, handler func(topic string, payload []byte, req *request)) error {
+	// paho.golang never removes a handler, so subscriptions which come and go
+	// have none
+	if handler != nil {
+		c.AddOnPublishReceived(func(p paho.PublishReceived) (bool, error) {
+			// every handler sees every message, so the subscription to the
+			// replies of Config.RoundTrip and the others leave each other's out
+			if c.responseTopic != "" && (p.Packet.Topic == c.responseTopic) != (topic == c.responseTopic) {
+				return false, nil
+			}
+
+			handler(p.Packet.Topic, p.Packet.Payload, requestOf(p.Packet))
+			return true, nil
+		})
+	}
+
+	subscribe := &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	}
+
+	suback, err := c.Client.Subscribe(context.Background(), subscribe)
+	if err != nil {
+		return err
+	}
+
+	// reason codes of 0x80 and above are failures
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("subscription refused with reason code %#x", suback.Reasons[0])
+	}
+
+	return nil
+}
+
+func (c client5) Unsubscribe(topic string) error {
+	unsuback, err := c.Client.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{topic}})
+	if err != nil {
+		return err
+	}
+
+	if len(unsuback.Reasons) > 0 && unsuback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("unsubscribe refused with reason code %#x", unsuback.Reasons[0])
+	}
+
+	return nil
+}
+
+// requestOf returns the request properties of publish, nil without any
+func requestOf(publish *paho.Publish) *request {
+	properties := publish.Properties
+	if properties == nil || (properties.ResponseTopic == "" && properties.CorrelationData == nil) {
+		return nil
+	}
+
+	return &request{responseTopic: properties.ResponseTopic, correlation: properties.CorrelationData}
+}
+
+func (c client5) Respond(req *request, payload []byte) error {
+	_, err := c.Client.Publish(context.Background(), &paho.Publish{
+		Topic:      req.responseTopic,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{CorrelationData: req.correlation},
+	})
+
+	return err
+}
+
+// ackTimeout bounds the wait for the ack of a blocking client5.Publish, like
+// the PacketTimeout of paho.golang's own blocking publish
+const ackTimeout = 10 * time.Second
+
+func (c client5) Publish(topic string, qos byte, retain bool, payload []byte, sent func()) error {
+	// paho.golang's blocking publish doesn't tell when the message was sent
+	acked := make(chan error, 1)
+	c.PublishAsync(topic, qos, retain, payload, func(err error) { acked <- err })
+	sent()
+	timer := time.NewTimer(ackTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-acked:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("publish not acknowledged in %v: %w", ackTimeout, context.DeadlineExceeded)
+	}
+}
+
+func (c client5) PublishAsync(topic string, qos byte, retain bool, payload []byte, done func(error)) {
+	publish := &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retain,
+		Payload: payload,
+	}
+
+	if c.responseTopic != "" {
+		// the header tells the reply's request and when it was sent
+		publish.Properties = &paho.PublishProperties{ResponseTopic: c.responseTopic, CorrelationData: payload[:headerSize]}
+	}
+
+	if c.aliases != nil {
+		c.aliases.apply(publish)
+	}
+
+	// QoS 0 publishes aren't acknowledged, and don't go through the session
+	if qos == 0 {
+		_, err := c.Client.Publish(context.Background(), publish)
+		done(err)
+		return
+	}
+
+	c.session.next = done
+	_, err := c.Client.PublishWithOptions(context.Background(), publish, paho.PublishOptions{Method: paho.PublishMethod_AsyncSend})
+	if c.session.next != nil {
+		// refused before it was added to the session
+		c.session.next = nil
+		done(err)
+	}
+}
+
+func (c client5) Connack() connack {
+	return c.ack
+}
+
+func (c client5) Kill() {
+	c.conn.Close()
+}
+
+func (c client5) Disconnect() {
+	c.lost.Do(func() { atomic.AddInt64(&c.metrics.active, -1) })
+	c.Client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	// paho.golang only closes sessions it created. Closing fails the publishes
+	// still waiting for an ack
+	c.session.Close()
+}
@@ -0,0 +1,30 @@
+package bench
+
+import (
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+func TestAckError(t *testing.T) {
+	tests := []struct {
+		name    string
+		ack     packets.ControlPacket
+		wantErr bool
+	}{
+		{"puback", packets.ControlPacket{Content: &packets.Puback{ReasonCode: packets.PubackSuccess}}, false},
+		{"puback without subscribers", packets.ControlPacket{Content: &packets.Puback{ReasonCode: packets.PubackNoMatchingSubscribers}}, false},
+		{"puback not authorized", packets.ControlPacket{Content: &packets.Puback{ReasonCode: packets.PubackNotAuthorized}}, true},
+		{"puback quota exceeded", packets.ControlPacket{Content: &packets.Puback{ReasonCode: packets.PubackQuotaExceeded}}, true},
+		{"pubrec", packets.ControlPacket{Content: &packets.Pubrec{ReasonCode: packets.PubrecSuccess}}, false},
+		{"pubrec refused", packets.ControlPacket{Content: &packets.Pubrec{ReasonCode: packets.PubrecImplementationSpecificError}}, true},
+		{"pubcomp", packets.ControlPacket{Content: &packets.Pubcomp{ReasonCode: packets.PubcompSuccess}}, false},
+		{"pubcomp unknown id", packets.ControlPacket{Content: &packets.Pubcomp{ReasonCode: packets.PubcompPacketIdentifierNotFound}}, true},
+	}
+
+	for _, test := range tests {
+		if err := ackError(test.ack); (err != nil) != test.wantErr {
+			t.Errorf("ackError(%v) = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
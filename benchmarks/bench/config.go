@@ -0,0 +1,536 @@
+package bench
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config describes a run. The tags are for github.com/alexflint/go-arg, which
+// the command line tool parses it with. Start from DefaultConfig
+type Config struct {
+	Broker       string        `arg:"-b,env:RUMQ_BENCH_BROKER" help:"Comma separated list of brokers, connections are spread round-robin"`
+	Connections  int           `arg:"-c,env:RUMQ_BENCH_CONNECTIONS" help:"Number of connections which publish and subscribe to their topic"`
+	PubConns     int           `arg:"--pub-conns,env:RUMQ_BENCH_PUB_CONNS" help:"Number of publish only connections. Use with --sub-conns instead of -c"`
+	SubConns     int           `arg:"--sub-conns,env:RUMQ_BENCH_SUB_CONNS" help:"Number of subscribe only connections. With %d in the topic, subscriber i listens to publisher i % pub-conns"`
+	FanIn        bool          `arg:"--fan-in,env:RUMQ_BENCH_FAN_IN" help:"Have the --pub-conns publishers all publish to one topic with a single subscriber, and report whether it keeps up"`
+	Messages     int           `arg:"-m,env:RUMQ_BENCH_MESSAGES" help:"Number of messages per connection"`
+	Duration     time.Duration `arg:"-d,env:RUMQ_BENCH_DURATION" help:"Publish for this long instead of a fixed number of messages (e.g. 60s)"`
+	Rate         int           `arg:"-r,env:RUMQ_BENCH_RATE" help:"Messages per second per connection. 0 is unlimited"`
+	ByteRate     int           `arg:"--byte-rate,env:RUMQ_BENCH_BYTE_RATE" help:"Payload bytes per second per connection. With --rate too, whichever limit is reached first paces the publishes. 0 is unlimited"`
+	Burst        string        `arg:"--burst,env:RUMQ_BENCH_BURST" help:"Publish in a repeating cycle of rates instead of --rate, like 100ms@10000,900ms@100 for a burst of 100ms at 10000 messages/sec per connection then 900ms at 100"`
+	Ramp         time.Duration `arg:"--ramp,env:RUMQ_BENCH_RAMP" help:"Spread connection establishment over this long instead of connecting all at once"`
+	Warmup       time.Duration `arg:"--warmup,env:RUMQ_BENCH_WARMUP" help:"Publish for this long before measuring. Messages sent during warmup are left out of the results"`
+	Churn        time.Duration `arg:"--churn,env:RUMQ_BENCH_CHURN" help:"Disconnect and reconnect every connection at this interval during the run"`
+	Workers      int           `arg:"--workers,env:RUMQ_BENCH_WORKERS" help:"Publish from at most this many connections at a time, each worker moving on to the next connection once one is done, instead of from every connection at once. 0 is unlimited"`
+	Async        bool          `arg:"--async,env:RUMQ_BENCH_ASYNC" help:"Publish without waiting for each acknowledgement, up to --max-inflight at a time"`
+	MsgDepth     int           `arg:"--message-depth,env:RUMQ_BENCH_MESSAGE_DEPTH" help:"With -V 5, how many received messages a client buffers for the subscriber, which is also the receive maximum the broker is told. 0 keeps paho's 65535"`
+	Store        string        `arg:"--store,env:RUMQ_BENCH_STORE" help:"Keep the QoS 1 and 2 messages the clients haven't had acknowledged in memory, or in files under this directory, one per client"`
+	MaxInflight  int           `arg:"--max-inflight,env:RUMQ_BENCH_MAX_INFLIGHT" help:"Most unacknowledged publishes per connection with --async, and when resuming a session"`
+	Drain        time.Duration `arg:"--drain,env:RUMQ_BENCH_DRAIN" help:"Once publishers finish, stop waiting for messages which are still missing when none arrive for this long"`
+	VerifyOrder  bool          `arg:"--verify-order,env:RUMQ_BENCH_VERIFY_ORDER" help:"Fail if a subscriber receives a publisher's messages out of the order they were sent in"`
+	MaxLoss      float64       `arg:"--max-loss,env:RUMQ_BENCH_MAX_LOSS" help:"Fail when more than this percentage of the messages are lost. Negative doesn't check"`
+	Buckets      string        `arg:"--latency-buckets,env:RUMQ_BENCH_LATENCY_BUCKETS" help:"Comma separated millisecond bounds (e.g. 1,5,10,50) to count the latencies between, for a histogram in the results"`
+	SloP99       time.Duration `arg:"--slo-p99,env:RUMQ_BENCH_SLO_P99" help:"Fail when the p99 latency is above this. 0 doesn't check"`
+	VerifyQos2   bool          `arg:"--verify-qos2,env:RUMQ_BENCH_VERIFY_QOS2" help:"Publish and subscribe at QoS 2 and fail if any message is duplicated or missing"`
+	Probe        bool          `arg:"--probe,env:RUMQ_BENCH_PROBE" help:"Only subscribe, with -c connections, to observe the messages of other publishers for --duration"`
+	ProbeHeader  bool          `arg:"--probe-header,env:RUMQ_BENCH_PROBE_HEADER" help:"The publishers watched by --probe start their messages with the 16 byte header of this tool, for latency and loss"`
+	SubChurn     bool          `arg:"--sub-churn,env:RUMQ_BENCH_SUB_CHURN" help:"Instead of benchmarking messages, have -c connections subscribe to their topics and unsubscribe again, -m times or for --duration, and report the SUBACK and UNSUBACK latencies"`
+	TestWill     bool          `arg:"--test-will,env:RUMQ_BENCH_TEST_WILL" help:"Instead of benchmarking, kill -c connections without a disconnect and check that the broker delivers their wills"`
+	WillTimeout  time.Duration `arg:"--will-timeout,env:RUMQ_BENCH_WILL_TIMEOUT" help:"How long --test-will waits for the wills"`
+	Retain       bool          `arg:"--retain,env:RUMQ_BENCH_RETAIN" help:"Publish retained messages"`
+	SubDelay     bool          `arg:"--sub-delay,env:RUMQ_BENCH_SUB_DELAY" help:"Connect subscribers only after publishers finish and time the delivery of retained messages. Needs --retain and --pub-conns"`
+	ConsumeDelay time.Duration `arg:"--consume-delay,env:RUMQ_BENCH_CONSUME_DELAY" help:"Hold up the subscribers this long after every message, like a slow consumer, to see whether the broker queues, drops or disconnects"`
+	PayloadSize  int           `arg:"-s,env:RUMQ_BENCH_PAYLOADSIZE" help:"Size of each message"`
+	PayloadDist  string        `arg:"--payload-dist,env:RUMQ_BENCH_PAYLOAD_DIST" help:"Pick the size of each message, header included, instead of -s. fixed:N, uniform:MIN-MAX or exp:MEAN"`
+	Seed         int64         `arg:"--seed,env:RUMQ_BENCH_SEED" help:"Seed of the random payloads and sizes, for repeatable runs. 0 picks one, which --verbose logs"`
+	PayloadFile  string        `arg:"--payload-file,env:RUMQ_BENCH_PAYLOAD_FILE" help:"Publish the contents of this file (after a 16 byte header) instead of random data"`
+	Topic        string        `arg:"-t,env:RUMQ_BENCH_TOPIC" help:"Topic to publish and subscribe on. %d is replaced by the connection index"`
+	Topics       int           `arg:"--topics,env:RUMQ_BENCH_TOPICS" help:"Spread the messages of every publisher over this many topics, --topic with /0 to /N-1 appended. Subscribers subscribe to topic/+"`
+	SharedGroup  string        `arg:"--shared-group,env:RUMQ_BENCH_SHARED_GROUP" help:"Subscribe as members of this shared subscription group, to $share/<group>/<filter>, so that each message goes to one of them. Needs -V 5"`
+	TopicAlias   bool          `arg:"--topic-alias,env:RUMQ_BENCH_TOPIC_ALIAS" help:"Publish with mqtt 5 topic aliases, up to the broker's maximum, and check that subscribers get the full topics. Needs -V 5"`
+	RoundTrip    bool          `arg:"--request-response,env:RUMQ_BENCH_REQUEST_RESPONSE" help:"Publish every message as an mqtt 5 request with a response topic and correlation data, have the subscribers reply and report the round trip time"`
+	SubTopic     string        `arg:"--sub-topic,env:RUMQ_BENCH_SUB_TOPIC" help:"Topic filter to subscribe to instead of the published topic. Can have + and # wildcards and %d like --topic"`
+	PubQos       int           `arg:"--pub-qos,env:RUMQ_BENCH_PUB_QOS" help:"QoS of published messages (0, 1 or 2)"`
+	SubQos       int           `arg:"--sub-qos,env:RUMQ_BENCH_SUB_QOS" help:"QoS of the subscription (0, 1 or 2)"`
+	Output       string        `arg:"-o,env:RUMQ_BENCH_OUTPUT" help:"Format of the results (text or json)"`
+	Csv          string        `arg:"--csv,env:RUMQ_BENCH_CSV" help:"Append per connection statistics to this csv file"`
+	Proxy        string        `arg:"--proxy,env:RUMQ_BENCH_PROXY" help:"Connect through this proxy, socks5://host:port or http://host:port with optional user:password@"`
+	LocalAddr    []string      `arg:"--local-addr,separate,env:RUMQ_BENCH_LOCAL_ADDR" help:"Source ip address of the connections, to pick the network interface. Can be repeated to spread the connections round-robin over more ephemeral ports"`
+	WsPath       string        `arg:"--ws-path,env:RUMQ_BENCH_WS_PATH" help:"Path of ws:// and wss:// brokers which don't have one in their url"`
+	WsHeader     []string      `arg:"--ws-header,separate,env:RUMQ_BENCH_WS_HEADER" help:"Header to send in the websocket handshake, as key=value. Can be repeated"`
+	NoDelay      bool          `arg:"--tcp-nodelay,env:RUMQ_BENCH_TCP_NODELAY" help:"Send small packets right away instead of coalescing them with Nagle's algorithm. --tcp-nodelay=false turns Nagle's algorithm on, which can raise the latency of small messages"`
+	MqttVersion  int           `arg:"-V,--mqtt-version,env:RUMQ_BENCH_MQTT_VERSION" help:"Mqtt protocol version. 3 (3.1), 4 (3.1.1) or 5"`
+	CaFile       string        `arg:"--cafile,env:RUMQ_BENCH_CAFILE" help:"CA certificate to verify the broker with"`
+	Cert         string        `arg:"--cert,env:RUMQ_BENCH_CERT" help:"Client certificate for tls authentication. Needs --key"`
+	Key          string        `arg:"--key,env:RUMQ_BENCH_KEY" help:"Client private key for tls authentication. Needs --cert"`
+	Insecure     bool          `arg:"--insecure,env:RUMQ_BENCH_INSECURE" help:"Don't verify the broker's certificate"`
+	ClientPrefix string        `arg:"--client-prefix,env:RUMQ_BENCH_CLIENT_PREFIX" help:"Prefix of the client ids. The host name and connection index are appended. Use a different one for concurrent runs from a host"`
+	KeepAlive    time.Duration `arg:"--keepalive,env:RUMQ_BENCH_KEEPALIVE" help:"Keep alive interval of the connections"`
+	CleanSession bool          `arg:"--clean-session,env:RUMQ_BENCH_CLEAN_SESSION" help:"Start every connection with a new session. --clean-session=false resumes the broker's session for the client id"`
+	Username     string        `arg:"-u,env:RUMQ_BENCH_USERNAME" help:"Username to connect with"`
+	Password     string        `arg:"-P,env:RUMQ_BENCH_PASSWORD" help:"Password to connect with. Set $RUMQ_BENCH_PASSWORD or $RUMQ_PASSWORD instead to keep it out of shell history and process lists"`
+	MetricsAddr  string        `arg:"--metrics-addr,env:RUMQ_BENCH_METRICS_ADDR" help:"Serve live prometheus metrics on this address (e.g. :9100) during the run"`
+	Timeseries   string        `arg:"--timeseries,env:RUMQ_BENCH_TIMESERIES" help:"Write the number of messages received every second to this csv file"`
+	ReportEvery  time.Duration `arg:"--report-interval,env:RUMQ_BENCH_REPORT_INTERVAL" help:"Log the rates and active connections so far at this interval during the run. 0 doesn't"`
+	Scenario     string        `arg:"--scenario,env:RUMQ_BENCH_SCENARIO" help:"Run the phases in this yaml file one after another, each overriding the other flags"`
+	ReuseConns   bool          `arg:"--reuse-connections,env:RUMQ_BENCH_REUSE_CONNECTIONS" help:"Keep the connections of a --scenario phase for the next one instead of reconnecting, where the phase has the same connection with the same subscription and sub QoS"`
+	Sink         string        `arg:"--results-sink,env:RUMQ_BENCH_RESULTS_SINK" help:"Also send the results of every connection over tcp to the --aggregator at this host:port, to combine the runs of several hosts"`
+	Aggregator   string        `arg:"--aggregator,env:RUMQ_BENCH_AGGREGATOR" help:"Instead of benchmarking, listen on this address for the results of --results-sink senders and report them combined"`
+	Senders      int           `arg:"--senders,env:RUMQ_BENCH_SENDERS" help:"Report once this many senders have sent their results to the --aggregator. 0 waits for an interrupt"`
+	DryRun       bool          `arg:"--dry-run,env:RUMQ_BENCH_DRY_RUN" help:"Print what the run would do, with an estimate of the data it would publish, and exit without connecting"`
+	RuntimeStats bool          `arg:"--runtime-stats,env:RUMQ_BENCH_RUNTIME_STATS" help:"Report the peak goroutines and gc pauses of the benchmark itself, to tell when the client is the bottleneck"`
+	MaxProcs     int           `arg:"--maxprocs,env:RUMQ_BENCH_MAXPROCS" help:"Set GOMAXPROCS for the run. 0 keeps the default of one per cpu"`
+	Quiet        bool          `arg:"-q,--quiet,env:RUMQ_BENCH_QUIET" help:"Only print the results and errors"`
+	Verbose      bool          `arg:"-v,--verbose,env:RUMQ_BENCH_VERBOSE" help:"Also log the lifecycle of every connection"`
+	// Logger receives the diagnostics of the run. When nil one writing to
+	// stderr at the level of Quiet and Verbose is used
+	Logger *slog.Logger `arg:"-"`
+}
+
+// Description is the help text above the flags, which go-arg doesn't list the
+// environment variables of
+func (Config) Description() string {
+	return "Every flag can also be set with an environment variable, RUMQ_BENCH_ and the long flag name in upper case with - as _ " +
+		"(RUMQ_BENCH_PUB_CONNS for --pub-conns, RUMQ_BENCH_CONNECTIONS for -c). The password is RUMQ_BENCH_PASSWORD or RUMQ_PASSWORD. " +
+		"Flags override environment variables, and repeated flags replace the values of theirs"
+}
+
+// DefaultConfig is a million QoS 1 messages over one connection to a local
+// broker
+func DefaultConfig() Config {
+	return Config{
+		Broker:       "tcp://localhost:1883",
+		Connections:  1,
+		Messages:     1000000,
+		PayloadSize:  100,
+		Topic:        "hello/world",
+		PubQos:       1,
+		SubQos:       1,
+		Output:       "text",
+		MqttVersion:  4,
+		Drain:        time.Second,
+		MaxInflight:  100,
+		Store:        memoryStore,
+		MaxLoss:      -1,
+		Topics:       1,
+		KeepAlive:    10 * time.Second,
+		CleanSession: true,
+		NoDelay:      true,
+		ClientPrefix: "paho-go",
+		WsPath:       "/mqtt",
+		WillTimeout:  10 * time.Second,
+		ReportEvery:  5 * time.Second,
+	}
+}
+
+// Every payload starts with a header of the publish time in nanoseconds (8
+// bytes), the publisher's index (4 bytes) and the message's sequence number
+// from that publisher (4 bytes), all little endian. Subscribers use these for
+// latency and loss measurement
+const headerSize = 16
+
+// validate checks the config and fills in the parts of r derived from it
+func (r *Runner) validate() error {
+	opts := &r.opts
+	for _, broker := range strings.Split(opts.Broker, ",") {
+		broker = strings.TrimSpace(broker)
+		if !validScheme(broker) {
+			return fmt.Errorf("broker %q should start with tcp://, ssl://, tls://, ws:// or wss://", broker)
+		}
+
+		r.brokers = append(r.brokers, withWsPath(broker, opts.WsPath))
+	}
+
+	r.wsHeaders = make(http.Header)
+	for _, header := range opts.WsHeader {
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("ws-header should be key=value. Found %q", header)
+		}
+
+		r.wsHeaders.Add(kv[0], kv[1])
+	}
+
+	var err error
+	if r.dialer, err = newDialer(opts); err != nil {
+		return err
+	}
+
+	if opts.Proxy != "" {
+		if r.dialer, err = newProxy(opts.Proxy, r.dialer); err != nil {
+			return err
+		}
+	}
+
+	if (opts.Cert == "") != (opts.Key == "") {
+		return errors.New("cert and key should be provided together")
+	}
+
+	if opts.CaFile != "" || opts.Cert != "" || opts.Insecure {
+		var err error
+		if r.tlsConfig, err = newTLSConfig(opts); err != nil {
+			return err
+		}
+
+		for _, broker := range r.brokers {
+			if !strings.HasPrefix(broker, "ssl://") && !strings.HasPrefix(broker, "tls://") && !strings.HasPrefix(broker, "wss://") {
+				return fmt.Errorf("tls needs an ssl://, tls:// or wss:// broker. Found %q", broker)
+			}
+		}
+	}
+
+	if opts.Quiet && opts.Verbose {
+		return errors.New("quiet and verbose can't be used together")
+	}
+
+	r.log = opts.Logger
+	if r.log == nil {
+		level := slog.LevelInfo
+		switch {
+		case opts.Quiet:
+			level = slog.LevelError
+		case opts.Verbose:
+			level = slog.LevelDebug
+		}
+
+		r.log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("host name for the client ids: %v", err)
+	}
+
+	r.clientPrefix = opts.ClientPrefix + "-" + host
+
+	if opts.Connections < 1 {
+		return errors.New("connections should be at least 1")
+	}
+
+	if opts.FanIn {
+		if opts.SubConns == 0 {
+			opts.SubConns = 1
+		}
+
+		if opts.PubConns == 0 || opts.SubConns != 1 || strings.Contains(opts.Topic, "%d") {
+			return errors.New("fan-in needs --pub-conns, one subscriber and a topic without %d")
+		}
+
+		// warmup messages aren't counted as received
+		if opts.SubDelay || opts.Probe || opts.SharedGroup != "" || opts.Warmup > 0 {
+			return errors.New("fan-in can't be used with sub-delay, probe, shared-group or warmup")
+		}
+	}
+
+	if opts.PubConns < 0 || opts.SubConns < 0 || (opts.PubConns > 0) != (opts.SubConns > 0) {
+		return errors.New("pub-conns and sub-conns should both be set")
+	}
+
+	if opts.SubDelay && (!opts.Retain || opts.PubConns == 0) {
+		return errors.New("sub-delay needs --retain and separate --pub-conns and --sub-conns")
+	}
+
+	if opts.Duration < 0 {
+		return errors.New("duration should be positive")
+	}
+
+	if opts.Ramp < 0 {
+		return errors.New("ramp should be positive")
+	}
+
+	if opts.Churn < 0 {
+		return errors.New("churn should be positive")
+	}
+
+	if opts.MaxInflight < 1 || opts.MaxInflight > math.MaxUint16 {
+		return fmt.Errorf("max-inflight should be between 1 and %v", math.MaxUint16)
+	}
+
+	if opts.Drain <= 0 {
+		return errors.New("drain should be positive")
+	}
+
+	if opts.ConsumeDelay < 0 {
+		return errors.New("consume-delay should be positive")
+	}
+
+	if _, err := parseBuckets(opts.Buckets); err != nil {
+		return err
+	}
+
+	if opts.SloP99 < 0 {
+		return errors.New("slo-p99 should be positive")
+	}
+
+	if opts.MaxProcs < 0 {
+		return errors.New("maxprocs should be positive")
+	}
+
+	if opts.ReportEvery < 0 {
+		return errors.New("report-interval should be positive")
+	}
+
+	if opts.Warmup < 0 {
+		return errors.New("warmup should be positive")
+	}
+
+	if opts.Warmup > 0 && opts.SubDelay {
+		return errors.New("warmup and sub-delay can't be used together")
+	}
+
+	if opts.KeepAlive < time.Second || opts.KeepAlive > math.MaxUint16*time.Second {
+		return fmt.Errorf("keepalive should be between 1s and %v", math.MaxUint16*time.Second)
+	}
+
+	if opts.VerifyQos2 {
+		// retained messages from earlier runs would look like duplicates
+		if opts.Duration > 0 || opts.Warmup > 0 || opts.Churn > 0 || opts.Retain {
+			return errors.New("verify-qos2 needs a fixed number of messages, without warmup, churn or retain")
+		}
+
+		opts.PubQos, opts.SubQos = 2, 2
+	}
+
+	if opts.Probe {
+		if opts.Duration == 0 {
+			return errors.New("probe needs a --duration")
+		}
+
+		if opts.PubConns > 0 || opts.SubDelay || opts.Warmup > 0 || opts.VerifyQos2 || opts.TestWill {
+			return errors.New("probe can't be used with pub-conns, sub-delay, warmup, verify-qos2 or test-will")
+		}
+	}
+
+	if opts.Topics < 1 {
+		return errors.New("topics should be at least 1")
+	}
+
+	// loss is told from the sequence of all the topics of a publisher
+	if opts.Topics > 1 && opts.SubTopic != "" {
+		return errors.New("topics and sub-topic can't be used together")
+	}
+
+	if opts.MsgDepth < 0 || opts.MsgDepth > math.MaxUint16 {
+		return fmt.Errorf("message-depth should be between 0 and %v", math.MaxUint16)
+	}
+
+	if opts.MsgDepth > 0 && opts.MqttVersion != 5 {
+		return errors.New("message-depth needs -V 5. paho.mqtt.golang hands mqtt 3 messages to the subscriber as they are read, without a buffer")
+	}
+
+	if opts.Store == "" {
+		opts.Store = memoryStore
+	}
+
+	if opts.TopicAlias && (opts.MqttVersion != 5 || opts.Probe) {
+		return errors.New("topic-alias needs -V 5, and publishers of the run rather than --probe")
+	}
+
+	if opts.SubChurn {
+		if opts.PubConns > 0 || opts.FanIn || opts.Probe || opts.TestWill || opts.SubDelay || opts.Warmup > 0 || opts.Churn > 0 || opts.RoundTrip {
+			return errors.New("sub-churn can't be used with pub-conns, fan-in, probe, test-will, sub-delay, warmup, churn or request-response")
+		}
+	}
+
+	if opts.Senders < 0 {
+		return errors.New("senders should be positive")
+	}
+
+	if opts.Sink != "" && (opts.Aggregator != "" || opts.Scenario != "" || opts.TestWill || opts.SubChurn) {
+		return errors.New("results-sink can't be used with aggregator, scenario, test-will or sub-churn")
+	}
+
+	// results only go over tcp, a connection's line can be larger than a
+	// datagram
+	for _, addr := range []string{opts.Sink, opts.Aggregator} {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			return fmt.Errorf("results-sink and aggregator should be a tcp host:port, other transports aren't supported. Found %q", addr)
+		}
+	}
+
+	if opts.Workers < 0 {
+		return errors.New("workers should be positive")
+	}
+
+	if opts.Workers > 0 && (opts.Duration > 0 || opts.Churn > 0 || opts.Probe) {
+		return errors.New("workers needs --messages, and can't be used with churn or probe, which keep every connection busy for the whole run")
+	}
+
+	// topic aliases count into the runner of the phase which connected the
+	// client, and churn replaces clients
+	if opts.ReuseConns && (opts.Churn > 0 || opts.TopicAlias) {
+		return errors.New("reuse-connections can't be used with churn or topic-alias")
+	}
+
+	if opts.RoundTrip {
+		if opts.MqttVersion != 5 {
+			return errors.New("request-response needs -V 5")
+		}
+
+		// replies come from the message handler of the client which got the
+		// request, and must not match the subscriptions of the run
+		if opts.Probe || opts.SubTopic != "" || opts.Churn > 0 || opts.TestWill {
+			return errors.New("request-response can't be used with probe, sub-topic, churn or test-will")
+		}
+	}
+
+	if opts.SharedGroup != "" {
+		if opts.MqttVersion != 5 {
+			return errors.New("shared-group needs -V 5")
+		}
+
+		if strings.ContainsAny(opts.SharedGroup, "/+#") {
+			return fmt.Errorf("shared-group can't have /, + or #. Found %q", opts.SharedGroup)
+		}
+
+		// members only get a share of each sequence
+		if opts.SubDelay || opts.VerifyQos2 {
+			return errors.New("shared-group can't be used with sub-delay or verify-qos2")
+		}
+	}
+
+	if opts.VerifyOrder && opts.Probe && !opts.ProbeHeader {
+		return errors.New("verify-order needs --probe-header when probing")
+	}
+
+	if opts.ProbeHeader && !opts.Probe {
+		return errors.New("probe-header needs --probe")
+	}
+
+	if opts.WillTimeout <= 0 {
+		return errors.New("will-timeout should be positive")
+	}
+
+	if opts.Rate < 0 {
+		return errors.New("rate should be positive")
+	}
+
+	if opts.ByteRate < 0 {
+		return errors.New("byte-rate should be positive")
+	}
+
+	if opts.Burst != "" {
+		if opts.Rate > 0 {
+			return errors.New("burst and rate can't be used together")
+		}
+
+		if opts.Probe || opts.SubDelay {
+			return errors.New("burst can't be used with probe or sub-delay, which don't measure the latency of what was published")
+		}
+
+		var err error
+		if r.burst, err = parseBurst(opts.Burst); err != nil {
+			return err
+		}
+	}
+
+	if opts.PubQos < 0 || opts.PubQos > 2 {
+		return fmt.Errorf("pub-qos should be 0, 1 or 2. Found %v", opts.PubQos)
+	}
+
+	if opts.SubQos < 0 || opts.SubQos > 2 {
+		return fmt.Errorf("sub-qos should be 0, 1 or 2. Found %v", opts.SubQos)
+	}
+
+	if opts.MqttVersion < 3 || opts.MqttVersion > 5 {
+		return fmt.Errorf("mqtt-version should be 3, 4 or 5. Found %v", opts.MqttVersion)
+	}
+
+	if opts.Output != "text" && opts.Output != "json" {
+		return fmt.Errorf("output should be text or json. Found %q", opts.Output)
+	}
+
+	if opts.PayloadFile != "" {
+		var err error
+		if r.fileData, err = os.ReadFile(opts.PayloadFile); err != nil {
+			return fmt.Errorf("failed to read payload file: %v", err)
+		}
+
+		opts.PayloadSize = headerSize + len(r.fileData)
+	}
+
+	if opts.PayloadDist != "" {
+		if opts.PayloadFile != "" {
+			return errors.New("payload-dist and payload-file can't be used together")
+		}
+
+		sizes, err := parseDistribution(opts.PayloadDist)
+		if err != nil {
+			return err
+		}
+
+		// messages are sliced from a template of the largest size
+		r.sizes = &sizes
+		opts.PayloadSize = sizes.max
+	}
+
+	r.seed = opts.Seed
+	if r.seed == 0 {
+		r.seed = time.Now().UnixNano()
+	}
+
+	r.log.Debug("seeded", "seed", r.seed)
+
+	if opts.PayloadSize < headerSize {
+		return fmt.Errorf("payload size should be at least %v bytes to carry the header", headerSize)
+	}
+
+	return nil
+}
+
+func validScheme(broker string) bool {
+	for _, scheme := range []string{"tcp://", "ssl://", "tls://", "ws://", "wss://"} {
+		if strings.HasPrefix(broker, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTLSConfig(opts *Config) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if opts.CaFile != "" {
+		ca, err := os.ReadFile(opts.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %v", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in ca file %v", opts.CaFile)
+		}
+	}
+
+	if opts.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// withWsPath adds path to websocket brokers without one
+func withWsPath(broker, path string) string {
+	uri, err := url.Parse(broker)
+	if err != nil || (uri.Scheme != "ws" && uri.Scheme != "wss") || uri.Path != "" {
+		return broker
+	}
+
+	uri.Path = path
+	return uri.String()
+}
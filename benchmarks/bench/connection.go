@@ -0,0 +1,895 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// role decides whether a connection publishes, subscribes or does both
+type role int
+
+const (
+	// loopback connections publish and subscribe to the same topic
+	loopback role = iota
+	publisher
+	subscriber
+)
+
+func (r role) publishes() bool {
+	return r != subscriber
+}
+
+func (r role) subscribes() bool {
+	return r != publisher
+}
+
+type connection struct {
+	r  *Runner
+	id string
+	// index identifies the connection amongst publishers in message headers
+	index uint32
+	topic string
+	// topics are what the connection publishes to, in turn. The topic, or
+	// the topic/0 to topic/N-1 of Config.Topics
+	topics []string
+	// filter is what the connection subscribes to. The topic unless
+	// --sub-topic is set
+	filter string
+	role   role
+	// connectTime is how long the broker took to accept the connection. 0
+	// when reused, the client coming from the pool of Config.ReuseConns
+	connectTime time.Duration
+	reused      bool
+	// connack is the broker's answer to the first connect, and lostSessions
+	// counts the reconnects without a clean session which didn't get the
+	// session back
+	connack      connack
+	lostSessions int
+	subscribed   time.Time
+	// total is the number of messages to publish. 0 publishes till the
+	// context passed to Start is done
+	total int
+	// expected is the number of messages this connection receives on its
+	// subscription. Set with expect before Start
+	expected int
+	done     chan struct{}
+	broker   string
+
+	// guards client, which churn replaces while publish uses it
+	clientMu   sync.Mutex
+	client     client
+	reconnects *histogram
+	// kept is the client in the pool of Config.ReuseConns, which goes back
+	// to the pool instead of disconnecting. nil without the pool
+	kept *pooled
+
+	// guards the receive side, which is updated from paho's goroutine while
+	// an interrupted Start snapshots it. The histograms are only allocated
+	// for the features the run uses, nil ones record nothing
+	mu           sync.Mutex
+	received     int
+	perTopic     topicCounts
+	minLatency   time.Duration
+	maxLatency   time.Duration
+	totalLatency time.Duration
+	latencies    *histogram
+	// bursts holds the latencies by when in a cycle of Config.Burst they
+	// were sent. nil without it
+	bursts *burstLatencies
+	// sequences holds the last sequence number received from each publisher
+	// on each topic. A jump ahead means that the messages in between were
+	// lost, and one back that they arrived out of order
+	sequences map[stream]uint32
+	lost      int
+	// reordered counts messages older than the last one from their publisher
+	// and firstReorder describes the first, for --verify-order
+	reordered    int
+	firstReorder string
+	// wrongTopics is the number of messages which arrived on another topic
+	// than they were published to with Config.TopicAlias, and
+	// firstWrongTopic the first
+	wrongTopics     int
+	firstWrongTopic string
+	// maxBacklog is the most messages published but not received yet at an
+	// arrival, for Config.FanIn
+	maxBacklog int64
+	discarded  int
+	// foreign is the number of messages too short to carry the header, which
+	// no publisher of the run sent. They are skipped
+	foreign int
+	// last is when the last message arrived
+	last time.Time
+	// arrivals holds the times between consecutive messages, for --probe
+	arrivals *histogram
+	// seen has a bit set for every sequence number received from each
+	// publisher, for --verify-qos2
+	seen       map[uint32][]uint64
+	duplicates []string
+
+	// bytes is the payload published and sizes the histogram of message sizes,
+	// recorded as a nanosecond per byte. Warmup isn't counted
+	bytes int
+	sizes *histogram
+	// rng picks message sizes. Each connection has its own so that they don't
+	// contend on the global source's lock
+	rng *rand.Rand
+	// sequence numbers the next publish. It carries on from warmup so that
+	// subscribers see a single sequence
+	sequence uint32
+	// inflight has a slot taken for every unacknowledged publish with
+	// Config.Async. nil otherwise
+	inflight chan struct{}
+	// guards acks, which async publishes record from their own goroutines
+	ackMu sync.Mutex
+	// acks holds the time from each QoS 1 and 2 publish being sent till the
+	// broker acknowledged it
+	acks *histogram
+	// sends holds the time the client took to send each publish. Only the
+	// publishing goroutine records it
+	sends *histogram
+	// roundTrips holds the times from each request till its reply arrived,
+	// and uncorrelated counts the replies which didn't match their request,
+	// for Config.RoundTrip. Guarded by mu
+	roundTrips   *histogram
+	uncorrelated int
+}
+
+// newConnection connects to the broker and, unless it is a publisher,
+// subscribes to the topic. With the pool of Config.ReuseConns it takes the
+// client an earlier phase left connected and subscribed when there is one
+func newConnection(r *Runner, spec spec, total int) (*connection, error) {
+	start := time.Now()
+	var kept *pooled
+	if r.pool != nil {
+		kept = r.pool.take(spec, r.opts.SubQos)
+	}
+
+	var client client
+	if kept != nil {
+		client = kept.client
+	} else {
+		var err error
+		if client, err = r.connect(spec.id, spec.broker, nil); err != nil {
+			return nil, fmt.Errorf("connect to %v failed: %v", spec.broker, err)
+		}
+	}
+
+	c := &connection{
+		r:           r,
+		id:          spec.id,
+		index:       spec.index,
+		topic:       spec.topic,
+		filter:      spec.filter,
+		role:        spec.role,
+		total:       total,
+		done:        make(chan struct{}),
+		broker:      spec.broker,
+		client:      client,
+		kept:        kept,
+		connectTime: time.Since(start),
+		reused:      kept != nil,
+		connack:     client.Connack(),
+		sequences:   make(map[stream]uint32),
+		seen:        make(map[uint32][]uint64),
+		rng:         rand.New(rand.NewSource(r.seed + 1 + int64(spec.index))),
+	}
+
+	c.topics = subtopics(c.topic, r.opts.Topics)
+
+	if r.opts.Async {
+		c.inflight = make(chan struct{}, r.opts.MaxInflight)
+	}
+
+	c.newHistograms()
+	if r.burst != nil && spec.role.subscribes() {
+		c.bursts = newBurstLatencies(len(r.burst.phases))
+	}
+
+	if kept != nil {
+		r.log.Debug("reused", "id", c.id, "broker", c.broker)
+		c.connectTime = 0
+		c.subscribed = time.Now()
+		kept.attach(c.msgHandler, c.responseHandler)
+		return c, nil
+	}
+
+	r.log.Debug("connected", "id", c.id, "broker", c.broker, "took", c.connectTime)
+	// pooled clients deliver to the connection of the phase using them
+	messages, responses := c.msgHandler, c.responseHandler
+	if r.pool != nil {
+		c.kept = &pooled{client: client, spec: spec, qos: r.opts.SubQos}
+		c.kept.attach(messages, responses)
+		messages, responses = c.kept.deliver, c.kept.respond
+	}
+
+	if r.opts.RoundTrip && c.role.publishes() {
+		if err := client.Subscribe(responseTopic(c.id), 0, responses); err != nil {
+			client.Disconnect()
+			return nil, fmt.Errorf("subscribe to the responses failed: %v", err)
+		}
+	}
+
+	if !c.role.subscribes() {
+		return c, nil
+	}
+
+	c.subscribed = time.Now()
+	subscription := r.subscription(c.filter)
+	if err := client.Subscribe(subscription, byte(c.r.opts.SubQos), messages); err != nil {
+		client.Disconnect()
+		return nil, fmt.Errorf("subscribe to %v failed: %v", subscription, err)
+	}
+
+	r.log.Debug("subscribed", "id", c.id, "filter", subscription)
+	return c, nil
+}
+
+// expect sets the number of messages to receive before Start reports. -1
+// receives till the context passed to Start is done
+func (c *connection) expect(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// retained messages can arrive before this is called
+	c.expected = n
+	if n == 0 || (n > 0 && c.received >= n) {
+		close(c.done)
+	}
+}
+
+// header is what every payload starts with, see headerSize
+type header struct {
+	sent      int64
+	publisher uint32
+	sequence  uint32
+}
+
+// decodeHeader reads the header at the start of payload. ok is false when
+// payload is too short to carry one, so it isn't from a publisher of the run
+func decodeHeader(payload []byte) (h header, ok bool) {
+	if len(payload) < headerSize {
+		return h, false
+	}
+
+	h.sent = int64(binary.LittleEndian.Uint64(payload))
+	h.publisher = binary.LittleEndian.Uint32(payload[8:])
+	h.sequence = binary.LittleEndian.Uint32(payload[12:])
+	return h, true
+}
+
+// put writes h at the start of payload, which has room for it
+func (h header) put(payload []byte) {
+	binary.LittleEndian.PutUint64(payload, uint64(h.sent))
+	binary.LittleEndian.PutUint32(payload[8:], h.publisher)
+	binary.LittleEndian.PutUint32(payload[12:], h.sequence)
+}
+
+// msgHandler is called by paho on a single goroutine per client
+func (c *connection) msgHandler(topic string, payload []byte, req *request) {
+	if c.r.opts.ConsumeDelay > 0 {
+		defer c.consume()
+	}
+
+	h, ok := decodeHeader(payload)
+	if c.r.opts.Probe && (!c.r.opts.ProbeHeader || !ok) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		atomic.AddUint64(&c.r.metrics.received, 1)
+		c.received++
+		c.perTopic.add(topic, 1)
+		c.arrived(time.Now())
+		return
+	}
+
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.foreign++
+		return
+	}
+
+	if req != nil && req.responseTopic != "" {
+		c.respond(req, payload)
+	}
+
+	sent, publisher, sequence := h.sent, h.publisher, h.sequence
+	latency := time.Since(time.Unix(0, sent))
+	if c.r.opts.SubDelay {
+		// retained messages are old. What matters is how soon they come
+		latency = time.Since(c.subscribed)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r.opts.VerifyQos2 {
+		c.verify(publisher, sequence)
+	}
+
+	if c.r.opts.TopicAlias {
+		c.checkTopic(topic, publisher, sequence)
+	}
+
+	if c.r.fanIn != nil {
+		c.maxBacklog = max(c.maxBacklog, c.r.fanIn.backlog())
+	}
+
+	// publishers go round Config.Topics, so the sequence numbers on one of
+	// them are that far apart
+	key, stride := stream{publisher, topic}, uint32(c.r.opts.Topics)
+	last, seen := c.sequences[key]
+	gap := 0
+	switch {
+	case !seen:
+		gap = int(sequence / stride)
+		c.sequences[key] = sequence
+	case sequence > last:
+		gap = int((sequence-last)/stride - 1)
+		c.sequences[key] = sequence
+	case sequence < last && c.r.opts.VerifyOrder:
+		if c.reordered == 0 {
+			c.firstReorder = fmt.Sprintf("publisher %v sequence %v after %v on %v", publisher, sequence, last, topic)
+		}
+
+		c.reordered++
+	}
+
+	if sent < c.r.warmupEnd.Load() {
+		c.discarded++
+		return
+	}
+
+	// members of a shared group only get some of the sequence. The group's
+	// loss is counted once the run is over
+	if c.r.opts.SharedGroup == "" {
+		c.lost += gap
+	}
+
+	if c.received == 0 || latency < c.minLatency {
+		c.minLatency = latency
+	}
+
+	if latency > c.maxLatency {
+		c.maxLatency = latency
+	}
+
+	c.totalLatency += latency
+	c.latencies.record(latency)
+	if c.bursts != nil {
+		c.bursts.record(c.r.burst, c.r.burst.offset(c.r.measureStart(), time.Unix(0, sent)), latency)
+	}
+
+	c.r.metrics.recordLatency(latency)
+	atomic.AddUint64(&c.r.metrics.received, 1)
+	c.received++
+	c.perTopic.add(topic, 1)
+	c.arrived(time.Now())
+	if c.received == c.expected {
+		close(c.done)
+	}
+}
+
+// respond replies to a request with its header. The client isn't replaced as
+// there is no churn with Config.RoundTrip
+func (c *connection) respond(req *request, payload []byte) {
+	responder, ok := c.client.(responder)
+	if !ok {
+		return
+	}
+
+	if err := responder.Respond(req, payload[:headerSize]); err != nil {
+		c.r.fail(c.id, publishFailed, err)
+	}
+}
+
+// responseHandler times the replies to the requests of the connection. A reply
+// carries its request's header as both the payload and the correlation data,
+// so a broker which mangles or mixes up correlation data shows as a mismatch
+func (c *connection) responseHandler(topic string, payload []byte, req *request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req == nil || len(payload) != headerSize || !bytes.Equal(req.correlation, payload) || binary.LittleEndian.Uint32(payload[8:]) != c.index {
+		c.uncorrelated++
+		return
+	}
+
+	sent := int64(binary.LittleEndian.Uint64(payload))
+	if sent < c.r.warmupEnd.Load() {
+		return
+	}
+
+	c.roundTrips.record(time.Since(time.Unix(0, sent)))
+}
+
+// checkTopic counts messages which arrived with another topic than the one
+// they were published to, as a broker resolving topic aliases wrongly would
+// deliver them
+func (c *connection) checkTopic(topic string, publisher, sequence uint32) {
+	published := c.r.topic(int(publisher))
+	if c.r.opts.Topics > 1 {
+		published += "/" + strconv.Itoa(int(sequence%uint32(c.r.opts.Topics)))
+	}
+
+	if topic == published {
+		return
+	}
+
+	if c.wrongTopics == 0 {
+		c.firstWrongTopic = fmt.Sprintf("publisher %v sequence %v on %q instead of %q", publisher, sequence, topic, published)
+	}
+
+	c.wrongTopics++
+}
+
+// stream is the messages of a publisher on a topic, which the broker has to
+// deliver in order
+type stream struct {
+	publisher uint32
+	topic     string
+}
+
+// arrived notes when the latest message arrived. Called with mu held, after
+// counting the message
+func (c *connection) arrived(now time.Time) {
+	if c.r.opts.Probe && c.received > 1 {
+		c.arrivals.record(now.Sub(c.last))
+	}
+
+	c.last = now
+}
+
+// verify marks sequence as seen from publisher and notes it if it was seen
+// before. Called with mu held
+func (c *connection) verify(publisher, sequence uint32) {
+	bits := c.seen[publisher]
+	word, bit := sequence/64, uint64(1)<<(sequence%64)
+	for uint32(len(bits)) <= word {
+		bits = append(bits, 0)
+	}
+
+	if bits[word]&bit != 0 {
+		c.duplicates = append(c.duplicates, fmt.Sprintf("publisher %v sequence %v", publisher, sequence))
+	}
+
+	bits[word] |= bit
+	c.seen[publisher] = bits
+}
+
+// missing lists the sequence numbers below Config.Messages which weren't
+// received from a publisher which was heard from. Publishers which weren't
+// heard from at all only show in the count. Called with mu held
+func (c *connection) missing() (count int, anomalies []string) {
+	for publisher, bits := range c.seen {
+		for sequence := uint32(0); sequence < uint32(c.r.opts.Messages); sequence++ {
+			word := sequence / 64
+			if word >= uint32(len(bits)) || bits[word]&(1<<(sequence%64)) == 0 {
+				anomalies = append(anomalies, fmt.Sprintf("publisher %v sequence %v", publisher, sequence))
+			}
+		}
+	}
+
+	unique := c.received - len(c.duplicates)
+	return c.expected - unique, anomalies
+}
+
+// Start publishes the messages and reports statistics once every expected
+// message is received. When ctx is done (interrupt or the end of a timed run)
+// it stops and reports whatever was accumulated till then
+func (c *connection) Start(ctx context.Context, template []byte, published *sync.WaitGroup, drained <-chan struct{}, stats chan Statistics) {
+	// each connection stamps its own headers, so it needs its own copy of the
+	// shared payload. As publishes are waited on one by one, this one buffer
+	// is restamped and reused for every message. Async publishes copy it
+	payload := append([]byte(nil), template...)
+	stopChurn, churned := make(chan struct{}), make(chan struct{})
+	go func() {
+		if c.r.opts.Churn > 0 {
+			c.churn(stopChurn)
+		}
+
+		close(churned)
+	}()
+
+	if c.role.publishes() {
+		c.warmup(ctx, payload)
+	} else {
+		select {
+		case <-time.After(time.Until(c.r.measureStart())):
+		case <-ctx.Done():
+		}
+	}
+
+	var start = time.Now()
+
+	sent := 0
+	if c.role.publishes() {
+		sent = c.publish(ctx, payload)
+		published.Done()
+	}
+
+	timeTaken := time.Since(start)
+	quiet := c.wait(ctx, drained)
+	close(stopChurn)
+	<-churned
+	c.finish(sent, start, timeTaken, quiet, stats)
+}
+
+// finish reports the statistics of the connection and disconnects it. quiet
+// is whether the wait for messages ended with none arriving for
+// Config.Drain
+func (c *connection) finish(sent int, start time.Time, timeTaken time.Duration, quiet bool, stats chan Statistics) {
+	// subscribers are timed till their last message
+	if !c.role.publishes() {
+		timeTaken = time.Since(start)
+		if last := c.lastReceived(); quiet && last.After(start) {
+			timeTaken = last.Sub(start)
+		}
+	}
+
+	s := c.statistics(sent, start, timeTaken)
+	c.r.log.Debug("finished", "id", c.id, "sent", s.sent, "received", s.received, "lost", s.lost)
+	// before reporting, so that the runner is done with the broker once it
+	// has every result, and the next run reusing the client ids doesn't take
+	// sessions over. Pooled clients stay connected for the next phase
+	if c.kept != nil {
+		c.r.pool.put(c.kept)
+	} else {
+		c.disconnect()
+	}
+
+	stats <- s
+}
+
+// disconnect disconnects from the broker cleanly, after giving the client a
+// moment to finish what it is sending
+func (c *connection) disconnect() {
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+
+	start := time.Now()
+	c.client.Disconnect()
+	c.r.log.Debug("disconnected", "id", c.id, "took", time.Since(start))
+}
+
+// wait returns once every expected message is received or ctx is done. Lost
+// messages never arrive, so once drained is closed (all publishers finished)
+// it also gives up when nothing arrives for Config.Drain, and returns true
+func (c *connection) wait(ctx context.Context, drained <-chan struct{}) bool {
+	select {
+	case <-c.done:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-drained:
+	}
+
+	ticker := time.NewTicker(c.r.opts.Drain)
+	defer ticker.Stop()
+	last := c.count()
+	for {
+		select {
+		case <-c.done:
+			return false
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		count := c.count()
+		if count == last {
+			return true
+		}
+
+		last = count
+	}
+}
+
+// count is the number of messages which arrived, including warmup ones
+func (c *connection) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received + c.discarded
+}
+
+func (c *connection) lastReceived() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// churn reconnects every Config.Churn till stop is closed
+func (c *connection) churn(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.r.opts.Churn)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		if err := c.reconnect(); err != nil {
+			c.r.log.Warn("reconnect failed", "id", c.id, "err", err)
+			c.r.fail(c.id, reconnectFailed, err)
+		}
+	}
+}
+
+// reconnect replaces the client with a new connection, subscribed again
+// unless it is a publisher. Messages published meanwhile are lost with a
+// clean session
+func (c *connection) reconnect() error {
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+
+	c.client.Disconnect()
+	start := time.Now()
+	client, err := c.r.connect(c.id, c.broker, nil)
+	if err != nil {
+		return err
+	}
+
+	c.reconnects.record(time.Since(start))
+	c.r.log.Debug("reconnected", "id", c.id, "took", time.Since(start), "session_present", client.Connack().sessionPresent)
+	if !c.r.opts.CleanSession && !client.Connack().sessionPresent {
+		c.lostSessions++
+	}
+
+	if c.role.subscribes() {
+		subscription := c.r.subscription(c.filter)
+		if err := client.Subscribe(subscription, byte(c.r.opts.SubQos), c.msgHandler); err != nil {
+			client.Disconnect()
+			return fmt.Errorf("subscribe to %v failed: %v", subscription, err)
+		}
+	}
+
+	c.client = client
+	return nil
+}
+
+// warmup publishes till warmupEnd. The messages are stamped before it, so
+// subscribers discard them
+func (c *connection) warmup(ctx context.Context, payload []byte) {
+	rate, byteRate := c.r.messageLimiter(), newLimiter(c.r.opts.ByteRate)
+	bytes := 0
+	for sent := 0; ctx.Err() == nil; sent++ {
+		if !rate.wait(ctx, sent) || !byteRate.wait(ctx, bytes) {
+			break
+		}
+
+		now := time.Now()
+		if !now.Before(c.r.measureStart()) {
+			break
+		}
+
+		bytes += c.send(payload, now, true)
+	}
+}
+
+// publish sends the messages and returns the number sent. Both the message
+// and byte rates pace it, so the tighter one governs
+func (c *connection) publish(ctx context.Context, payload []byte) int {
+	rate, byteRate := c.r.messageLimiter(), newLimiter(c.r.opts.ByteRate)
+	sent := 0
+	for ; (c.total == 0 || sent < c.total) && ctx.Err() == nil; sent++ {
+		if !rate.wait(ctx, sent) || !byteRate.wait(ctx, c.bytes) {
+			break
+		}
+
+		size := c.send(payload, time.Now(), false)
+		c.bytes += size
+		c.sizes.record(time.Duration(size))
+	}
+
+	c.flush()
+	return sent
+}
+
+// send stamps the header into payload and publishes it, cut to the size
+// picked by Config.PayloadDist. Returns the size sent. Warmup publishes are
+// left out of the counters and the send and ack latencies
+func (c *connection) send(payload []byte, now time.Time, warmup bool) int {
+	if c.r.sizes != nil {
+		payload = payload[:c.r.sizes.size(c.rng)]
+	}
+
+	header{sent: now.UnixNano(), publisher: c.index, sequence: c.sequence}.put(payload)
+	topic := c.topics[c.sequence%uint32(len(c.topics))]
+	c.sequence++
+	if !warmup {
+		atomic.AddUint64(&c.r.metrics.sentBytes, uint64(len(payload)))
+	}
+
+	if c.inflight != nil {
+		c.sendAsync(topic, append([]byte(nil), payload...), warmup)
+		return len(payload)
+	}
+
+	c.clientMu.Lock()
+	at := time.Now()
+	var sent time.Time
+	err := c.client.Publish(topic, byte(c.r.opts.PubQos), c.r.opts.Retain, payload, func() {
+		sent = time.Now()
+		if !warmup {
+			c.sends.record(sent.Sub(at))
+		}
+	})
+	c.clientMu.Unlock()
+	if warmup {
+		return len(payload)
+	}
+
+	c.acked(sent, err)
+	atomic.AddUint64(&c.r.metrics.sent, 1)
+	return len(payload)
+}
+
+// sendAsync publishes without waiting for the ack once the inflight window
+// has room. The broker's acks pace the publishes
+func (c *connection) sendAsync(topic string, payload []byte, warmup bool) {
+	c.inflight <- struct{}{}
+	c.clientMu.Lock()
+	at := time.Now()
+	// acks can come before PublishAsync returns, timed from before the send
+	var sent atomic.Int64
+	sent.Store(at.UnixNano())
+	c.client.PublishAsync(topic, byte(c.r.opts.PubQos), c.r.opts.Retain, payload, func(err error) {
+		// warmup acks can come after measuring starts
+		if !warmup {
+			c.acked(time.Unix(0, sent.Load()), err)
+		}
+		<-c.inflight
+	})
+
+	now := time.Now()
+	sent.Store(now.UnixNano())
+	c.clientMu.Unlock()
+	if !warmup {
+		c.sends.record(now.Sub(at))
+		atomic.AddUint64(&c.r.metrics.sent, 1)
+	}
+}
+
+// acked records the ack latency of a publish which was sent at the given
+// time, or its failure
+func (c *connection) acked(at time.Time, err error) {
+	if err != nil {
+		c.r.fail(c.id, publishFailed, err)
+		return
+	}
+
+	if c.r.opts.PubQos == 0 {
+		return
+	}
+
+	latency := time.Since(at)
+	c.ackMu.Lock()
+	c.acks.record(latency)
+	c.ackMu.Unlock()
+}
+
+// flush waits till every async publish is acknowledged
+func (c *connection) flush() {
+	for i := 0; i < cap(c.inflight); i++ {
+		c.inflight <- struct{}{}
+	}
+
+	for i := 0; i < cap(c.inflight); i++ {
+		<-c.inflight
+	}
+}
+
+// subtopics is the topics a publisher on topic goes round with Config.Topics
+func subtopics(topic string, n int) []string {
+	if n <= 1 {
+		return []string{topic}
+	}
+
+	topics := make([]string, n)
+	for i := range topics {
+		topics[i] = topic + "/" + strconv.Itoa(i)
+	}
+
+	return topics
+}
+
+// newHistograms allocates the histograms the connection records into in this
+// run, each of them some 30KB
+func (c *connection) newHistograms() {
+	opts := &c.r.opts
+	if c.role.subscribes() {
+		c.latencies = new(histogram)
+	}
+
+	if opts.Probe {
+		c.arrivals = new(histogram)
+	}
+
+	if opts.Churn > 0 {
+		c.reconnects = new(histogram)
+	}
+
+	if !c.role.publishes() {
+		return
+	}
+
+	c.sends = new(histogram)
+	if opts.PubQos > 0 {
+		c.acks = new(histogram)
+	}
+
+	if c.r.sizes != nil {
+		c.sizes = new(histogram)
+	}
+
+	if opts.RoundTrip {
+		c.roundTrips = new(histogram)
+	}
+}
+
+// statistics hands the histograms of the connection over to the Statistics,
+// and anything the connection records after is left out
+func (c *connection) statistics(sent int, start time.Time, timeTaken time.Duration) Statistics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Statistics{
+		id:              c.id,
+		role:            c.role,
+		topic:           c.topic,
+		filter:          c.filter,
+		connectTime:     c.connectTime,
+		reused:          c.reused,
+		connack:         c.connack,
+		lostSessions:    c.lostSessions,
+		sent:            sent,
+		received:        c.received,
+		expected:        c.expected,
+		perTopic:        c.perTopic.clone(),
+		bursts:          c.bursts,
+		lost:            c.lost,
+		reordered:       c.reordered,
+		firstReorder:    c.firstReorder,
+		wrongTopics:     c.wrongTopics,
+		firstWrongTopic: c.firstWrongTopic,
+		maxBacklog:      c.maxBacklog,
+		uncorrelated:    c.uncorrelated,
+		discarded:       c.discarded,
+		foreign:         c.foreign,
+		start:           start,
+		timeTaken:       timeTaken,
+		totalSize:       c.bytes,
+		minLatency:      c.minLatency,
+		maxLatency:      c.maxLatency,
+		latencies:       c.latencies,
+		reconnects:      c.reconnects,
+		sends:           c.sends,
+		sizes:           c.sizes,
+		arrivals:        c.arrivals,
+		roundTrips:      c.roundTrips,
+		lastReceived:    c.last,
+	}
+
+	if c.received > 0 {
+		s.avgLatency = c.totalLatency / time.Duration(c.received)
+	}
+
+	if c.r.opts.VerifyQos2 && c.role.subscribes() {
+		s.duplicates = c.duplicates
+		s.missing, s.missingSequences = c.missing()
+	}
+
+	// messages still arriving are guarded by mu, churn has stopped and
+	// publishing is done, with flush having waited for the async acks
+	c.latencies, c.arrivals, c.roundTrips, c.bursts = nil, nil, nil, nil
+	c.reconnects, c.sizes, c.sends = nil, nil, nil
+	c.ackMu.Lock()
+	s.acks, c.acks = c.acks, nil
+	c.ackMu.Unlock()
+	return s
+}
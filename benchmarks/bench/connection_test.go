@@ -0,0 +1,129 @@
+package bench
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	tests := []header{
+		{sent: 0, publisher: 0, sequence: 0},
+		{sent: time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC).UnixNano(), publisher: 7, sequence: 1 << 31},
+		{sent: -1, publisher: 1<<32 - 1, sequence: 1<<32 - 1},
+	}
+
+	for _, want := range tests {
+		// the rest of the payload is left alone
+		payload := make([]byte, headerSize+4)
+		payload[headerSize] = 0xff
+		want.put(payload)
+		got, ok := decodeHeader(payload)
+		if !ok || got != want {
+			t.Errorf("decodeHeader(put(%+v)) = %+v, %v", want, got, ok)
+		}
+
+		if payload[headerSize] != 0xff {
+			t.Errorf("put(%+v) wrote past the header", want)
+		}
+	}
+}
+
+func TestDecodeShortHeader(t *testing.T) {
+	for _, n := range []int{0, 1, 4, 8, headerSize - 1} {
+		if _, ok := decodeHeader(make([]byte, n)); ok {
+			t.Errorf("decodeHeader of %v bytes is ok, want too short", n)
+		}
+	}
+
+	if _, ok := decodeHeader(make([]byte, headerSize)); !ok {
+		t.Error("decodeHeader of a bare header isn't ok")
+	}
+}
+
+func TestForeignMessages(t *testing.T) {
+	r := &Runner{opts: Config{Topics: 1}, metrics: new(metrics)}
+	c := &connection{r: r, role: subscriber, done: make(chan struct{}), sequences: make(map[stream]uint32), seen: make(map[uint32][]uint64)}
+	c.newHistograms()
+
+	// messages of other publishers on the topic, too short for the header
+	for _, payload := range [][]byte{nil, {1}, make([]byte, headerSize-1)} {
+		c.msgHandler("topic", payload, nil)
+	}
+
+	payload := make([]byte, headerSize)
+	header{sent: time.Now().UnixNano()}.put(payload)
+	c.msgHandler("topic", payload, nil)
+	if c.foreign != 3 || c.received != 1 {
+		t.Errorf("foreign = %v, received = %v, want 3 and 1", c.foreign, c.received)
+	}
+
+	s := c.statistics(0, time.Now(), time.Second)
+	if s.foreign != 3 || s.latencies.count() != 1 {
+		t.Errorf("statistics have %v foreign and %v latencies, want 3 and 1", s.foreign, s.latencies.count())
+	}
+}
+
+func TestSubtopics(t *testing.T) {
+	tests := []struct {
+		topic string
+		n     int
+		want  []string
+	}{
+		{"a", 0, []string{"a"}},
+		{"a", 1, []string{"a"}},
+		{"a/b", 3, []string{"a/b/0", "a/b/1", "a/b/2"}},
+	}
+
+	for _, test := range tests {
+		if got := subtopics(test.topic, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("subtopics(%q, %v) = %v, want %v", test.topic, test.n, got, test.want)
+		}
+	}
+}
+
+// testClient acks every publish with err
+type testClient struct {
+	client
+	err          error
+	disconnected bool
+}
+
+func (t *testClient) Disconnect() {
+	t.disconnected = true
+}
+
+func (t *testClient) Publish(topic string, qos byte, retain bool, payload []byte, sent func()) error {
+	sent()
+	return t.err
+}
+
+func (t *testClient) PublishAsync(topic string, qos byte, retain bool, payload []byte, done func(error)) {
+	done(t.err)
+}
+
+func TestWarmupSends(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		r := &Runner{opts: Config{PubQos: 1, Topics: 1}, metrics: new(metrics), errs: make(chan error, 4)}
+		c := &connection{r: r, role: publisher, topics: []string{"topic"}, client: &testClient{}}
+		if async {
+			c.inflight = make(chan struct{}, 2)
+		}
+
+		c.newHistograms()
+		payload := make([]byte, headerSize)
+		c.send(payload, time.Now(), true)
+		c.client = &testClient{err: errors.New("refused")}
+		c.send(payload, time.Now(), true)
+		if c.sends.count() != 0 || c.acks.count() != 0 || r.metrics.sent != 0 || r.metrics.sentBytes != 0 || len(r.errs) != 0 {
+			t.Errorf("async %v: warmup recorded %v sends, %v acks, %v sent, %v bytes and %v failures", async, c.sends.count(), c.acks.count(), r.metrics.sent, r.metrics.sentBytes, len(r.errs))
+		}
+
+		c.client = &testClient{}
+		c.send(payload, time.Now(), false)
+		if c.sends.count() != 1 || c.acks.count() != 1 || r.metrics.sent != 1 || r.metrics.sentBytes != headerSize {
+			t.Errorf("async %v: recorded %v sends, %v acks, %v sent and %v bytes, want one of each", async, c.sends.count(), c.acks.count(), r.metrics.sent, r.metrics.sentBytes)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package bench
+
+import "time"
+
+// ConsumeReport describes how the broker coped with subscribers slowed down
+// by Config.ConsumeDelay: whether it kept up delivery, dropped messages or
+// disconnected the subscribers
+type ConsumeReport struct {
+	DelayMillis float64 `json:"delay_ms"`
+	Subscribers int     `json:"subscribers"`
+	// CapacityRate is the most messages per second the subscribers can take
+	// between them at the delay
+	CapacityRate float64 `json:"capacity_msgs_per_sec"`
+	// PublishRate is the sum of the publishers' rates, each over its own
+	// time publishing
+	PublishRate  float64 `json:"publish_msgs_per_sec"`
+	DeliveryRate float64 `json:"delivery_msgs_per_sec"`
+	// Undelivered is the messages the subscribers of a run with -m should
+	// have received but didn't, lost ones included
+	Undelivered int `json:"undelivered,omitempty"`
+	Lost        int `json:"lost"`
+	// Disconnects is the connections lost during the run, keep alive
+	// timeouts included
+	Disconnects int `json:"disconnects"`
+}
+
+func newConsumeReport(opts *Config, results []Statistics, aggregate *Aggregate, errors map[string]int) *ConsumeReport {
+	report := &ConsumeReport{
+		DelayMillis:  millis(opts.ConsumeDelay),
+		DeliveryRate: aggregate.receiveThroughput(),
+		Lost:         aggregate.lost,
+		Disconnects:  errors[disconnected] + errors[keepAliveTimeout],
+	}
+
+	for _, s := range results {
+		if s.role.publishes() {
+			report.PublishRate += s.throughput()
+		}
+
+		if !s.role.subscribes() {
+			continue
+		}
+
+		report.Subscribers++
+		if s.expected > 0 {
+			report.Undelivered += max(s.expected-s.received, 0)
+		}
+	}
+
+	report.CapacityRate = float64(report.Subscribers) / opts.ConsumeDelay.Seconds()
+	return report
+}
+
+// consume holds the message handler up for Config.ConsumeDelay, like a slow
+// downstream would. It is deferred first in the handler, so it runs after
+// the message is counted and the lock released
+func (c *connection) consume() {
+	time.Sleep(c.r.opts.ConsumeDelay)
+}
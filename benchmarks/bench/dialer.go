@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/proxy"
+)
+
+// localDialer opens connections from the addresses of Config.LocalAddr in
+// turn, to pick the network interface or to have more ephemeral ports than one
+// address has
+type localDialer struct {
+	dialers []*net.Dialer
+	next    atomic.Uint64
+}
+
+// newLocalDialer parses addrs, ip addresses with an optional port
+func newLocalDialer(addrs []string) (*localDialer, error) {
+	d := new(localDialer)
+	for _, addr := range addrs {
+		host, port := addr, 0
+		if h, p, err := net.SplitHostPort(addr); err == nil {
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("local-addr %q has a bad port", addr)
+			}
+
+			host = h
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("local-addr should be an ip address. Found %q", addr)
+		}
+
+		local := &net.TCPAddr{IP: ip, Port: port}
+		d.dialers = append(d.dialers, &net.Dialer{Timeout: dialTimeout, LocalAddr: local})
+	}
+
+	return d, nil
+}
+
+func (d *localDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer := d.dialers[(d.next.Add(1)-1)%uint64(len(d.dialers))]
+	conn, err := dialer.Dial(network, addr)
+	// binding fails the same way when the ports are used up as when the
+	// address isn't on this host
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return nil, fmt.Errorf("local address %v is out of ephemeral ports or not on this host, spread the connections with more --local-addr: %w", dialer.LocalAddr, err)
+	}
+
+	return conn, err
+}
+
+// newDialer returns the direct dialer, bound to Config.LocalAddr when set
+func newDialer(opts *Config) (proxy.Dialer, error) {
+	if len(opts.LocalAddr) == 0 {
+		return &net.Dialer{Timeout: dialTimeout}, nil
+	}
+
+	return newLocalDialer(opts.LocalAddr)
+}
@@ -0,0 +1,131 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WritePlan writes what Run would do without connecting: the resolved
+// config, the connections and an estimate of the data they would publish.
+// For Config.DryRun, to catch a mistyped -m before it hits a broker
+func (r *Runner) WritePlan(w io.Writer) {
+	opts := &r.opts
+	fmt.Fprintln(w, "Brokers =", strings.Join(r.brokers, ", "))
+	fmt.Fprintln(w, "Mqtt version =", opts.MqttVersion, ", Publish QoS =", opts.PubQos, ", Subscribe QoS =", opts.SubQos, ", Retain =", opts.Retain)
+	if opts.TestWill {
+		fmt.Fprintln(w, "Test wills of", opts.Connections, "connections, waiting", opts.WillTimeout, "for them")
+		return
+	}
+
+	if opts.SubChurn {
+		fmt.Fprintln(w, "Churn the subscriptions of", opts.Connections, "connections to", opts.Topics, "filters each")
+		return
+	}
+
+	specs := r.plan()
+	publishers, subscribers := 0, 0
+	var topics, filters []string
+	seenTopics, seenFilters := make(map[string]bool), make(map[string]bool)
+	for _, spec := range specs {
+		if spec.role.publishes() {
+			publishers++
+			if !seenTopics[spec.topic] {
+				seenTopics[spec.topic] = true
+				topics = append(topics, spec.topic)
+			}
+		}
+
+		if spec.role.subscribes() {
+			subscribers++
+			if !seenFilters[spec.filter] {
+				seenFilters[spec.filter] = true
+				filters = append(filters, r.subscription(spec.filter))
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "Connections =", len(specs), ", Publishing =", publishers, ", Subscribing =", subscribers)
+	if len(topics) > 0 {
+		fmt.Fprintln(w, "Topics =", len(topics)*opts.Topics, ", Published to =", sample(topics))
+	}
+
+	if len(filters) > 0 {
+		fmt.Fprintln(w, "Subscriptions =", sample(filters))
+	}
+
+	payload := strconv.Itoa(opts.PayloadSize)
+	if opts.PayloadDist != "" {
+		payload = opts.PayloadDist
+	}
+
+	size := r.averageSize()
+	fmt.Fprintln(w, "Payload (bytes) =", payload, ", Rate (messages/sec) =", opts.Rate, ", Byte rate (bytes/sec) =", opts.ByteRate)
+	if r.burst != nil {
+		fmt.Fprintln(w, "Burst =", opts.Burst, ", Average rate (messages/sec) =", r.burst.average())
+	}
+
+	messages, bounded := opts.Messages, opts.Duration == 0
+	if !bounded {
+		// only the rates bound a run for a duration
+		seconds := opts.Duration.Seconds()
+		if opts.Rate > 0 {
+			messages, bounded = int(float64(opts.Rate)*seconds), true
+		}
+
+		if r.burst != nil {
+			messages, bounded = int(r.burst.average()*seconds), true
+		}
+
+		if byRate := int(float64(opts.ByteRate) * seconds / size); opts.ByteRate > 0 && (!bounded || byRate < messages) {
+			messages, bounded = byRate, true
+		}
+	}
+
+	if !bounded {
+		fmt.Fprintln(w, "Messages per publisher = as many as the broker takes in", opts.Duration, ", no estimate without --rate, --burst or --byte-rate")
+		return
+	}
+
+	total := float64(publishers) * float64(messages)
+	fmt.Fprintln(w, "Messages per publisher =", messages, ", Total messages =", int64(total), ", Estimated data published =", humanBytes(total*size))
+	if opts.Warmup > 0 {
+		fmt.Fprintln(w, "Warmup of", opts.Warmup, "publishes more on top")
+	}
+}
+
+// averageSize is the mean size of the published messages
+func (r *Runner) averageSize() float64 {
+	switch {
+	case r.fileData != nil:
+		return float64(headerSize + len(r.fileData))
+	case r.sizes != nil:
+		return r.sizes.average()
+	}
+
+	return float64(r.opts.PayloadSize)
+}
+
+// sample lists the first few of names, without flooding the terminal for
+// thousands of connections
+func sample(names []string) string {
+	const shown = 3
+	if len(names) <= shown {
+		return strings.Join(names, ", ")
+	}
+
+	return strings.Join(names[:shown], ", ") + fmt.Sprintf(" and %v more", len(names)-shown)
+}
+
+// humanBytes formats n bytes in the largest unit which keeps it above 1
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for n >= 1000 && unit < len(units)-1 {
+		n /= 1000
+		unit++
+	}
+
+	return fmt.Sprintf("%.2f %v", n, units[unit])
+}
@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// failure is a non-fatal error of a connection during a run. Runs carry on
+// through them, but the report tallies them by kind to show how healthy the
+// broker was
+type failure struct {
+	id   string
+	kind string
+	err  error
+}
+
+func (f failure) Error() string {
+	return f.kind + " failed for " + f.id + ": " + f.err.Error()
+}
+
+// kinds of failures. Timeouts are told apart whatever the operation, and
+// disconnects for an unanswered keep alive ping from the rest. Brokers often
+// stop answering pings under load before they stop taking publishes
+const (
+	publishFailed    = "publish"
+	reconnectFailed  = "reconnect"
+	disconnected     = "disconnect"
+	timedOut         = "timeout"
+	keepAliveTimeout = "keepalive"
+	// subscribes and unsubscribes of Config.SubChurn
+	subscribeFailed = "subscribe"
+)
+
+// fail reports a failure of the connection id to the collector
+func (r *Runner) fail(id, kind string, err error) {
+	var netErr net.Error
+	switch {
+	case kind == disconnected && pingTimedOut(err):
+		kind = keepAliveTimeout
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		kind = timedOut
+	}
+
+	// clients can fail after the runner is closed, like on disconnecting
+	select {
+	case r.errs <- failure{id: id, kind: kind, err: err}:
+	case <-r.closed:
+	}
+}
+
+// pingTimedOut reports whether err is the client giving up on a PINGRESP.
+// Neither paho library exports the error, paho.mqtt.golang reports "pingresp
+// not received" and paho.golang "PINGRESP timed out"
+func pingTimedOut(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "pingresp")
+}
+
+// collect tallies failures till the runner is closed. A tally request gets
+// the counts since the previous one, including failures still in the channel
+func (r *Runner) collect() {
+	counts := make(map[string]int)
+	add := func(err error) {
+		var f failure
+		if errors.As(err, &f) {
+			counts[f.kind]++
+		}
+
+		r.log.Debug("failure", "err", err)
+	}
+
+	for {
+		select {
+		case err := <-r.errs:
+			add(err)
+		case reply := <-r.tally:
+			for pending := len(r.errs); pending > 0; pending-- {
+				add(<-r.errs)
+			}
+
+			reply <- counts
+			counts = make(map[string]int)
+		case <-r.closed:
+			return
+		}
+	}
+}
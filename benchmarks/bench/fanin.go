@@ -0,0 +1,85 @@
+package bench
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FanInReport describes whether the single subscriber of Config.FanIn kept
+// up with the publishers
+type FanInReport struct {
+	Publishers  int     `json:"publishers"`
+	ReceiveRate float64 `json:"receive_msgs_per_sec"`
+	// MaxBacklog is the most messages published but not yet received at the
+	// arrival of a message
+	MaxBacklog int64 `json:"max_backlog"`
+	// SecondsBehind is the number of seconds in which the subscriber received
+	// fewer messages than were published, of Seconds sampled
+	SecondsBehind int  `json:"seconds_behind"`
+	Seconds       int  `json:"seconds"`
+	FellBehind    bool `json:"fell_behind"`
+}
+
+// fanIn tracks the backlog of the subscriber of Config.FanIn from the live
+// counters, relative to their values at the start of the run
+type fanIn struct {
+	metrics                *metrics
+	sentBase, receivedBase uint64
+	// seconds and behind are the samples of watch
+	seconds, behind int
+}
+
+func newFanIn(m *metrics) *fanIn {
+	return &fanIn{metrics: m, sentBase: atomic.LoadUint64(&m.sent), receivedBase: atomic.LoadUint64(&m.received)}
+}
+
+// backlog is the number of messages published but not received. A message
+// can arrive before its publish is counted, so it is never below 0
+func (f *fanIn) backlog() int64 {
+	sent := int64(atomic.LoadUint64(&f.metrics.sent) - f.sentBase)
+	received := int64(atomic.LoadUint64(&f.metrics.received) - f.receivedBase)
+	return max(sent-received, 0)
+}
+
+// watch samples every second whether the subscriber received less than was
+// published in that second, till stop is closed. A second is only behind
+// when the backlog grew too, so that a subscriber delivering the last
+// second's messages isn't counted
+func (f *fanIn) watch(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	sent, received, backlog := atomic.LoadUint64(&f.metrics.sent), atomic.LoadUint64(&f.metrics.received), f.backlog()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		nowSent, nowReceived, nowBacklog := atomic.LoadUint64(&f.metrics.sent), atomic.LoadUint64(&f.metrics.received), f.backlog()
+		if nowSent == sent && nowReceived == received {
+			continue
+		}
+
+		f.seconds++
+		if nowReceived-received < nowSent-sent && nowBacklog > backlog {
+			f.behind++
+		}
+
+		sent, received, backlog = nowSent, nowReceived, nowBacklog
+	}
+}
+
+// report sums up the fan in from the results of the run
+func (f *fanIn) report(results []Statistics, aggregate *Aggregate) *FanInReport {
+	report := &FanInReport{Publishers: aggregate.publishers, MaxBacklog: aggregate.maxBacklog, SecondsBehind: f.behind, Seconds: f.seconds, FellBehind: f.behind > 0}
+	for _, s := range results {
+		if s.role == subscriber {
+			report.ReceiveRate = s.receiveThroughput()
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,159 @@
+package bench
+
+import (
+	"context"
+	"math/bits"
+	"time"
+)
+
+const (
+	// histogramSubBits sets the precision of the latency histogram. Values
+	// are bucketed with 1/2^(histogramSubBits-1) relative error
+	histogramSubBits    = 7
+	histogramSubBuckets = 1 << histogramSubBits
+	histogramHalf       = histogramSubBuckets / 2
+	histogramBuckets    = histogramSubBuckets + (64-histogramSubBits)*histogramHalf
+)
+
+// histogram is a log-linear (hdr style) latency histogram with a fixed
+// memory footprint irrespective of the number of samples. A nil histogram is
+// empty and records nothing, for features the run doesn't use
+type histogram struct {
+	counts [histogramBuckets]uint64
+	total  uint64
+}
+
+func (h *histogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+
+	if d < 0 {
+		d = 0
+	}
+
+	h.counts[bucket(uint64(d))]++
+	h.total++
+}
+
+// merge adds the samples of other into h, which isn't nil
+func (h *histogram) merge(other *histogram) {
+	if other == nil {
+		return
+	}
+
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+
+	h.total += other.total
+}
+
+// count is the number of samples
+func (h *histogram) count() uint64 {
+	if h == nil {
+		return 0
+	}
+
+	return h.total
+}
+
+// percentile returns the lower bound of the bucket holding the pth percentile
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.count() == 0 {
+		return 0
+	}
+
+	rank := uint64(p / 100 * float64(h.total))
+	if rank >= h.total {
+		rank = h.total - 1
+	}
+
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen > rank {
+			return time.Duration(lowerBound(i))
+		}
+	}
+
+	return 0
+}
+
+// below returns the number of samples below d, to the precision of the
+// buckets
+func (h *histogram) below(d time.Duration) uint64 {
+	var count uint64
+	if h == nil {
+		return 0
+	}
+
+	end := bucket(uint64(max(d, 0)))
+	for _, n := range h.counts[:end] {
+		count += n
+	}
+
+	return count
+}
+
+func bucket(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+
+	shift := uint(bits.Len64(v) - histogramSubBits)
+	return histogramSubBuckets + int(shift-1)*histogramHalf + int(v>>shift) - histogramHalf
+}
+
+func lowerBound(index int) uint64 {
+	if index < histogramSubBuckets {
+		return uint64(index)
+	}
+
+	index -= histogramSubBuckets
+	shift := uint(index/histogramHalf + 1)
+	return uint64(index%histogramHalf+histogramHalf) << shift
+}
+
+// limiter paces a loop so that it doesn't go faster than rate units per second
+// on average. A rate of 0 is unlimited
+type limiter struct {
+	rate  float64
+	start time.Time
+	// schedule paces by Config.Burst instead, with start the beginning of a
+	// cycle and base the messages due in it before the limiter was made
+	schedule *schedule
+	base     float64
+}
+
+func newLimiter(rate int) *limiter {
+	return &limiter{rate: float64(rate), start: time.Now()}
+}
+
+// wait blocks till the units sent so far are within the rate. Returns false
+// if ctx is done before that
+func (l *limiter) wait(ctx context.Context, sent int) bool {
+	if l.rate == 0 && l.schedule == nil {
+		return true
+	}
+
+	due := l.start.Add(time.Duration(float64(sent) / l.rate * float64(time.Second)))
+	if l.schedule != nil {
+		due = l.start.Add(l.schedule.at(l.base + float64(sent)))
+	}
+
+	delay := time.Until(due)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,123 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBounds(t *testing.T) {
+	tests := []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, 1 << 40, 1<<63 + 12345}
+	for _, v := range tests {
+		i := bucket(v)
+		if i < 0 || i >= histogramBuckets {
+			t.Errorf("bucket(%v) = %v, out of range", v, i)
+			continue
+		}
+
+		lower := lowerBound(i)
+		if lower > v {
+			t.Errorf("lowerBound(bucket(%v)) = %v, above the value", v, lower)
+		}
+
+		// the relative error of a bucket is 1/2^(histogramSubBits-1)
+		if v-lower > v>>(histogramSubBits-1) {
+			t.Errorf("lowerBound(bucket(%v)) = %v, too far below the value", v, lower)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	h := new(histogram)
+	// under histogramSubBuckets nanoseconds every value has its own bucket
+	for d := time.Duration(1); d <= 100; d++ {
+		h.record(d)
+	}
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1},
+		{50, 51},
+		{95, 96},
+		{99, 100},
+		{100, 100},
+	}
+
+	for _, test := range tests {
+		if got := h.percentile(test.p); got != test.want {
+			t.Errorf("percentile(%v) = %v, want %v", test.p, got, test.want)
+		}
+	}
+
+	if got := h.count(); got != 100 {
+		t.Errorf("count() = %v, want 100", got)
+	}
+}
+
+func TestBelow(t *testing.T) {
+	h := new(histogram)
+	for _, d := range []time.Duration{10, 20, 30, -5} {
+		h.record(d)
+	}
+
+	tests := []struct {
+		d    time.Duration
+		want uint64
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 1},
+		{10, 1},
+		{11, 2},
+		{31, 4},
+	}
+
+	for _, test := range tests {
+		if got := h.below(test.d); got != test.want {
+			t.Errorf("below(%v) = %v, want %v", test.d, got, test.want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := new(histogram), new(histogram)
+	a.record(time.Millisecond)
+	b.record(time.Millisecond)
+	b.record(time.Second)
+	a.merge(b)
+	a.merge(nil)
+	if a.count() != 3 || a.below(time.Second) != 2 {
+		t.Errorf("merged histogram has %v samples, %v below a second, want 3 and 2", a.count(), a.below(time.Second))
+	}
+}
+
+func TestNilHistogram(t *testing.T) {
+	var h *histogram
+	h.record(time.Millisecond)
+	if h.count() != 0 || h.percentile(99) != 0 || h.below(time.Second) != 0 || h.sparse() != nil {
+		t.Error("a nil histogram should be empty")
+	}
+}
+
+func TestSparse(t *testing.T) {
+	h := new(histogram)
+	for _, d := range []time.Duration{time.Microsecond, time.Millisecond, time.Millisecond, time.Minute} {
+		h.record(d)
+	}
+
+	got := fromSparse(h.sparse())
+	if got.counts != h.counts || got.total != h.total {
+		t.Errorf("fromSparse(sparse()) = %v samples, want the %v of the histogram", got.total, h.total)
+	}
+
+	if fromSparse(nil) != nil {
+		t.Error("fromSparse(nil) should be nil")
+	}
+
+	// out of range buckets are left out
+	got = fromSparse([][2]uint64{{1, 2}, {histogramBuckets, 5}})
+	if got.total != 2 || got.counts[1] != 2 {
+		t.Errorf("fromSparse with a bucket out of range = %v samples, want 2", got.total)
+	}
+}
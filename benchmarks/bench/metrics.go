@@ -0,0 +1,83 @@
+package bench
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds, in seconds, of the prometheus latency
+// histogram buckets
+var latencyBounds = [...]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics are live counters across all connections of a runner, served with
+// --metrics-addr. Updated atomically
+type metrics struct {
+	sent     uint64
+	received uint64
+	active   int64
+	// sentBytes is the payload bytes published
+	sentBytes uint64
+	// latencyCounts has a bucket per latencyBounds and one for +Inf.
+	// latencySum is in nanoseconds
+	latencyCounts [len(latencyBounds) + 1]uint64
+	latencySum    uint64
+}
+
+func (m *metrics) recordLatency(latency time.Duration) {
+	i := sort.SearchFloat64s(latencyBounds[:], latency.Seconds())
+	atomic.AddUint64(&m.latencyCounts[i], 1)
+	atomic.AddUint64(&m.latencySum, uint64(latency))
+}
+
+func (m *metrics) write(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP rumq_bench_messages_sent_total Messages published")
+	fmt.Fprintln(w, "# TYPE rumq_bench_messages_sent_total counter")
+	fmt.Fprintln(w, "rumq_bench_messages_sent_total", atomic.LoadUint64(&m.sent))
+
+	fmt.Fprintln(w, "# HELP rumq_bench_bytes_sent_total Payload bytes published")
+	fmt.Fprintln(w, "# TYPE rumq_bench_bytes_sent_total counter")
+	fmt.Fprintln(w, "rumq_bench_bytes_sent_total", atomic.LoadUint64(&m.sentBytes))
+
+	fmt.Fprintln(w, "# HELP rumq_bench_messages_received_total Messages received on subscriptions")
+	fmt.Fprintln(w, "# TYPE rumq_bench_messages_received_total counter")
+	fmt.Fprintln(w, "rumq_bench_messages_received_total", atomic.LoadUint64(&m.received))
+
+	fmt.Fprintln(w, "# HELP rumq_bench_connections_active Connections currently connected")
+	fmt.Fprintln(w, "# TYPE rumq_bench_connections_active gauge")
+	fmt.Fprintln(w, "rumq_bench_connections_active", atomic.LoadInt64(&m.active))
+
+	fmt.Fprintln(w, "# HELP rumq_bench_latency_seconds End to end message latency")
+	fmt.Fprintln(w, "# TYPE rumq_bench_latency_seconds histogram")
+	var count uint64
+	for i, bound := range latencyBounds {
+		count += atomic.LoadUint64(&m.latencyCounts[i])
+		fmt.Fprintf(w, "rumq_bench_latency_seconds_bucket{le=\"%v\"} %v\n", bound, count)
+	}
+
+	count += atomic.LoadUint64(&m.latencyCounts[len(latencyBounds)])
+	fmt.Fprintf(w, "rumq_bench_latency_seconds_bucket{le=\"+Inf\"} %v\n", count)
+	fmt.Fprintln(w, "rumq_bench_latency_seconds_sum", time.Duration(atomic.LoadUint64(&m.latencySum)).Seconds())
+	fmt.Fprintln(w, "rumq_bench_latency_seconds_count", count)
+}
+
+// serve starts the metrics endpoint. Shutdown the returned server when the
+// run is done
+func (m *metrics) serve(addr string, log *slog.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.write)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics server failed", "err", err)
+		}
+	}()
+
+	return server
+}
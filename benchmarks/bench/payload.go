@@ -0,0 +1,99 @@
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// expCap bounds exponential sizes at this many times the mean, so that the
+// template to slice messages from has a size. Larger ones are rarer than one
+// in a million
+const expCap = 16
+
+// distribution picks the size of each message, header included. Parsed from
+// Config.PayloadDist
+type distribution struct {
+	kind     string
+	min, max int
+	mean     float64
+}
+
+// parseDistribution parses fixed:N, uniform:MIN-MAX and exp:MEAN
+func parseDistribution(s string) (distribution, error) {
+	kind, params := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, params = s[:i], s[i+1:]
+	}
+
+	d := distribution{kind: kind}
+	var err error
+	switch kind {
+	case "fixed":
+		d.min, err = strconv.Atoi(params)
+		d.max = d.min
+	case "uniform":
+		bounds := strings.SplitN(params, "-", 2)
+		if len(bounds) != 2 {
+			return d, fmt.Errorf("uniform payload distribution should be uniform:MIN-MAX. Found %q", s)
+		}
+
+		if d.min, err = strconv.Atoi(bounds[0]); err == nil {
+			d.max, err = strconv.Atoi(bounds[1])
+		}
+	case "exp":
+		d.mean, err = strconv.ParseFloat(params, 64)
+		d.min, d.max = headerSize, int(d.mean*expCap)
+	default:
+		return d, fmt.Errorf("payload distribution should be fixed:N, uniform:MIN-MAX or exp:MEAN. Found %q", s)
+	}
+
+	if err != nil {
+		return d, fmt.Errorf("payload distribution %q: %v", s, err)
+	}
+
+	if d.min < headerSize || (kind == "exp" && d.mean < headerSize) {
+		return d, fmt.Errorf("payload distribution sizes should be at least %v bytes to carry the header", headerSize)
+	}
+
+	if d.max < d.min {
+		return d, fmt.Errorf("payload distribution %q has its minimum above its maximum", s)
+	}
+
+	return d, nil
+}
+
+// size picks the size of the next message
+func (d *distribution) size(rng *rand.Rand) int {
+	switch d.kind {
+	case "uniform":
+		return d.min + rng.Intn(d.max-d.min+1)
+	case "exp":
+		size := int(rng.ExpFloat64() * d.mean)
+		if size < d.min {
+			return d.min
+		}
+
+		if size > d.max {
+			return d.max
+		}
+
+		return size
+	}
+
+	return d.min
+}
+
+// average is the mean size of the messages, ignoring the cap on exponential
+// ones
+func (d *distribution) average() float64 {
+	switch d.kind {
+	case "uniform":
+		return float64(d.min+d.max) / 2
+	case "exp":
+		return d.mean
+	}
+
+	return float64(d.min)
+}
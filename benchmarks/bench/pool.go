@@ -0,0 +1,126 @@
+package bench
+
+import "sync"
+
+// pool keeps the clients of a scenario's phases connected for the next phase,
+// for Config.ReuseConns, so that phases measure the message path without the
+// cost of connecting. The runners of the phases share one
+type pool struct {
+	mu      sync.Mutex
+	clients map[string]*pooled
+}
+
+// pooled is a client kept across phases. Its subscriptions deliver to the
+// handlers of the connection using it, and nowhere between phases
+type pooled struct {
+	client client
+	// the spec and subscribe QoS it was connected with. A connection with
+	// another subscription or role connects afresh
+	spec spec
+	qos  int
+
+	mu        sync.Mutex
+	messages  func(topic string, payload []byte, req *request)
+	responses func(topic string, payload []byte, req *request)
+}
+
+func newPool() *pool {
+	return &pool{clients: make(map[string]*pooled)}
+}
+
+// take removes the client of spec from the pool. nil when there isn't one, or
+// when it was connected for another subscription, which is disconnected
+func (p *pool) take(spec spec, qos int) *pooled {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := p.clients[spec.id]
+	if kept == nil {
+		return nil
+	}
+
+	delete(p.clients, spec.id)
+	if kept.spec != spec || kept.qos != qos {
+		kept.client.Disconnect()
+		return nil
+	}
+
+	return kept
+}
+
+// keep disconnects the clients which none of specs takes at qos, as a
+// phase starts, so that they don't go on getting its messages
+func (p *pool) keep(specs []spec, qos int) {
+	taken := make(map[string]spec, len(specs))
+	for _, spec := range specs {
+		taken[spec.id] = spec
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, kept := range p.clients {
+		if spec, ok := taken[id]; !ok || kept.spec != spec || kept.qos != qos {
+			kept.client.Disconnect()
+			delete(p.clients, id)
+		}
+	}
+}
+
+// put returns a client to the pool once its connection is done with it
+func (p *pool) put(kept *pooled) {
+	kept.attach(nil, nil)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[kept.spec.id] = kept
+}
+
+// close disconnects every client in the pool, once the scenario is over
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, kept := range p.clients {
+		kept.client.Disconnect()
+		delete(p.clients, id)
+	}
+}
+
+// attach sends the messages of the client's subscriptions to the given
+// handlers. nil ones drop them
+func (k *pooled) attach(messages, responses func(topic string, payload []byte, req *request)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.messages, k.responses = messages, responses
+}
+
+// deliver is the handler of the client's subscription
+func (k *pooled) deliver(topic string, payload []byte, req *request) {
+	k.mu.Lock()
+	handler := k.messages
+	k.mu.Unlock()
+	if handler != nil {
+		handler(topic, payload, req)
+	}
+}
+
+// respond is the handler of the client's subscription to the replies of
+// Config.RoundTrip
+func (k *pooled) respond(topic string, payload []byte, req *request) {
+	k.mu.Lock()
+	handler := k.responses
+	k.mu.Unlock()
+	if handler != nil {
+		handler(topic, payload, req)
+	}
+}
+
+// newSharingRunner is NewRunner for a phase after the first with the pool.
+// The runner counts into the metrics and failures of first, whose clients
+// every phase may reuse, so that first's collector tallies for the pool
+func newSharingRunner(config Config, first *Runner) (*Runner, error) {
+	r := &Runner{opts: config, metrics: first.metrics, errs: first.errs, tally: first.tally, closed: first.closed, sharing: true}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
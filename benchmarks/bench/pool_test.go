@@ -0,0 +1,31 @@
+package bench
+
+import "testing"
+
+func TestPoolKeep(t *testing.T) {
+	kept := spec{id: "a", topic: "t", filter: "t", role: subscriber}
+	tests := []struct {
+		name     string
+		specs    []spec
+		qos      int
+		wantKept bool
+	}{
+		{name: "taken", specs: []spec{kept}, qos: 1, wantKept: true},
+		{name: "not in the phase", specs: []spec{{id: "b", topic: "t", filter: "t", role: subscriber}}, qos: 1},
+		{name: "another subscription", specs: []spec{{id: "a", topic: "t", filter: "u", role: subscriber}}, qos: 1},
+		{name: "another qos", specs: []spec{kept}, qos: 2},
+		{name: "no connections", qos: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := new(testClient)
+			p := newPool()
+			p.put(&pooled{client: client, spec: kept, qos: 1})
+			p.keep(test.specs, test.qos)
+			if got := p.clients["a"] != nil; got != test.wantKept || client.disconnected == test.wantKept {
+				t.Errorf("kept %v and disconnected %v, want kept %v", got, client.disconnected, test.wantKept)
+			}
+		})
+	}
+}
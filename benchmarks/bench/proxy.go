@@ -0,0 +1,89 @@
+package bench
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout bounds opening a network connection, through a proxy or not
+const dialTimeout = 30 * time.Second
+
+// newProxy returns the dialer of Config.Proxy, which reaches the proxy with
+// direct. socks5:// is handled by x/net/proxy, http:// tunnels with CONNECT
+func newProxy(raw string, direct proxy.Dialer) (proxy.Dialer, error) {
+	uri, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %q: %v", raw, err)
+	}
+
+	switch uri.Scheme {
+	case "socks5", "socks5h":
+		return proxy.FromURL(uri, direct)
+	case "http":
+		return &httpProxy{uri: uri, forward: direct}, nil
+	}
+
+	return nil, fmt.Errorf("proxy should start with socks5:// or http://. Found %q", raw)
+}
+
+// httpProxy opens tunnels through an http proxy with CONNECT
+type httpProxy struct {
+	uri     *url.URL
+	forward proxy.Dialer
+}
+
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	conn, err := p.forward.Dial(network, p.uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	// the response to a CONNECT has no body, which ReadResponse needs the
+	// request to know
+	connect := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if p.uri.User != nil {
+		password, _ := p.uri.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.uri.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, connect)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect to %v: %v", addr, err)
+	}
+
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect to %v: %v", addr, response.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{conn, reader}, nil
+}
+
+// bufferedConn reads what the proxy sent after its response, which the
+// response reader may already hold, before the rest of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,58 @@
+package bench
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// a proxy which answers the CONNECT and sends on what the broker would
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		requests <- request
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nbroker")
+		io.Copy(io.Discard, conn)
+	}()
+
+	dialer, err := newProxy("http://user:secret@"+listener.Addr().String(), &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", "broker:1883")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "broker:1883" || request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("proxy got %v %v with %v", request.Method, request.Host, request.Header)
+	}
+
+	// the bytes after the response are the tunnel's
+	data := make([]byte, len("broker"))
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "broker" {
+		t.Errorf("read %q, %v from the tunnel, want broker", data, err)
+	}
+}
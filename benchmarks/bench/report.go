@@ -0,0 +1,563 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report is the outcome of a run. The exported fields are the structured
+// results, and the json output of the tool
+type Report struct {
+	Connections []ConnectionReport `json:"connections,omitempty"`
+	Aggregate   *AggregateReport   `json:"aggregate,omitempty"`
+	// Wills is only set by Config.TestWill runs
+	Wills *WillReport `json:"wills,omitempty"`
+	// Shared is only set with Config.SharedGroup
+	Shared *SharedReport `json:"shared,omitempty"`
+	// FanIn is only set with Config.FanIn
+	FanIn *FanInReport `json:"fan_in,omitempty"`
+	// Burst is only set with Config.Burst
+	Burst *BurstReport `json:"burst,omitempty"`
+	// Consume is only set with Config.ConsumeDelay
+	Consume *ConsumeReport `json:"consume,omitempty"`
+	// SubChurn is only set by Config.SubChurn runs
+	SubChurn *SubChurnReport `json:"sub_churn,omitempty"`
+	// Topics is the received messages per topic, the busiest first, when
+	// they arrived on more than one. OtherTopics counts the messages on the
+	// topics past the first thousand, which aren't listed
+	Topics      []TopicReport `json:"topics,omitempty"`
+	OtherTopics int           `json:"other_topics_received,omitempty"`
+	// Runtime is only set with Config.RuntimeStats
+	Runtime *RuntimeReport `json:"runtime,omitempty"`
+	// Errors counts the failures during the run by kind: publish, reconnect,
+	// disconnect, subscribe, timeout and keepalive, connections lost to an
+	// unanswered ping
+	Errors map[string]int `json:"errors,omitempty"`
+	// Violations describe why the run failed, empty when it passed
+	Violations []string `json:"violations,omitempty"`
+
+	opts      Config
+	results   []Statistics
+	aggregate *Aggregate
+}
+
+type LatencyReport struct {
+	MinMicros float64 `json:"min_us"`
+	AvgMicros float64 `json:"avg_us"`
+	MaxMicros float64 `json:"max_us"`
+	P50Micros float64 `json:"p50_us"`
+	P95Micros float64 `json:"p95_us"`
+	P99Micros float64 `json:"p99_us"`
+}
+
+type ConnectionReport struct {
+	Id             string            `json:"id"`
+	Sent           int               `json:"sent"`
+	Received       int               `json:"received"`
+	Lost           int               `json:"lost"`
+	Discarded      int               `json:"warmup_discarded,omitempty"`
+	Foreign        int               `json:"foreign,omitempty"`
+	Duplicates     int               `json:"duplicates,omitempty"`
+	Missing        int               `json:"missing,omitempty"`
+	OutOfOrder     int               `json:"out_of_order,omitempty"`
+	WrongTopic     int               `json:"wrong_topic,omitempty"`
+	Uncorrelated   int               `json:"uncorrelated_responses,omitempty"`
+	DurationMillis int64             `json:"duration_ms"`
+	TotalSize      int               `json:"total_size_bytes"`
+	PayloadMean    float64           `json:"payload_mean_bytes,omitempty"`
+	PayloadP99     int64             `json:"payload_p99_bytes,omitempty"`
+	Throughput     float64           `json:"throughput_msgs_per_sec"`
+	MBps           float64           `json:"throughput_mbps"`
+	TargetMBps     float64           `json:"target_mbps,omitempty"`
+	Receive        float64           `json:"receive_throughput_msgs_per_sec"`
+	Latency        LatencyReport     `json:"latency"`
+	LatencyBuckets []BucketReport    `json:"latency_buckets,omitempty"`
+	ConnectMillis  float64           `json:"connect_ms,omitempty"`
+	Reused         bool              `json:"reused,omitempty"`
+	SessionPresent bool              `json:"session_present,omitempty"`
+	AssignedID     string            `json:"assigned_client_id,omitempty"`
+	LostSessions   int               `json:"lost_sessions,omitempty"`
+	Reconnects     *ReconnectReport  `json:"reconnects,omitempty"`
+	Ack            *PercentileReport `json:"ack_latency,omitempty"`
+	Send           *PercentileReport `json:"send_time,omitempty"`
+	RoundTrip      *PercentileReport `json:"round_trip,omitempty"`
+	InterArrival   *PercentileReport `json:"inter_arrival,omitempty"`
+}
+
+type ReconnectReport struct {
+	Count     uint64  `json:"count"`
+	P50Millis float64 `json:"p50_ms"`
+	P95Millis float64 `json:"p95_ms"`
+	P99Millis float64 `json:"p99_ms"`
+}
+
+// PercentileReport summarizes a distribution of times, like the time from a
+// publish till the broker acknowledges it
+type PercentileReport struct {
+	P50Micros float64 `json:"p50_us"`
+	P95Micros float64 `json:"p95_us"`
+	P99Micros float64 `json:"p99_us"`
+}
+
+type ConnectReport struct {
+	MinMillis float64 `json:"min_ms"`
+	AvgMillis float64 `json:"avg_ms"`
+	MaxMillis float64 `json:"max_ms"`
+	// Reused is the number of connections left out, which didn't connect
+	// with --reuse-connections
+	Reused int `json:"reused,omitempty"`
+}
+
+type AggregateReport struct {
+	ConnectionReport
+	Connect           ConnectReport `json:"connect"`
+	Connections       int           `json:"connections"`
+	Topics            int           `json:"topics"`
+	SessionsPresent   int           `json:"sessions_present"`
+	Concurrency       int           `json:"concurrency,omitempty"`
+	AliasSavedBytes   int64         `json:"topic_alias_saved_bytes,omitempty"`
+	FailedConnections int           `json:"failed_connections"`
+	Interrupted       bool          `json:"interrupted"`
+}
+
+type WillReport struct {
+	Killed            int     `json:"killed"`
+	Delivered         int     `json:"delivered"`
+	FailedConnections int     `json:"failed_connections"`
+	P50Millis         float64 `json:"p50_ms"`
+	P95Millis         float64 `json:"p95_ms"`
+	P99Millis         float64 `json:"p99_ms"`
+
+	latencies *histogram
+}
+
+// OK is false when the run found the broker misbehaving or missing its
+// targets. Violations says how
+func (r *Report) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// check lists the ways the run failed: connections which failed, qos 2
+// anomalies when verified is false, and Config.MaxLoss and Config.SloP99
+func (r *Report) check(verified bool) []string {
+	var violations []string
+	opts, aggregate := &r.opts, r.aggregate
+	if aggregate.failed > 0 {
+		violations = append(violations, fmt.Sprintf("%v of %v connections failed", aggregate.failed, aggregate.connections+aggregate.failed))
+	}
+
+	if !verified {
+		violations = append(violations, "qos 2 messages were duplicated or missing")
+	}
+
+	if aggregate.reordered > 0 {
+		violations = append(violations, fmt.Sprintf("%v messages arrived out of order, first %v", aggregate.reordered, aggregate.firstReorder))
+	}
+
+	if aggregate.wrongTopics > 0 {
+		violations = append(violations, fmt.Sprintf("%v messages arrived on the wrong topic, first %v", aggregate.wrongTopics, aggregate.firstWrongTopic))
+	}
+
+	// a clean session never has one to resume
+	if opts.CleanSession && aggregate.sessionsPresent > 0 {
+		violations = append(violations, fmt.Sprintf("the broker told %v connections with a clean session that it had their session", aggregate.sessionsPresent))
+	}
+
+	if aggregate.lostSessions > 0 {
+		violations = append(violations, fmt.Sprintf("%v reconnects without a clean session didn't get their session back", aggregate.lostSessions))
+	}
+
+	if aggregate.uncorrelated > 0 {
+		violations = append(violations, fmt.Sprintf("%v responses didn't match the correlation data of their request", aggregate.uncorrelated))
+	}
+
+	if loss := aggregate.lossPercent(); opts.MaxLoss >= 0 && loss > opts.MaxLoss {
+		violations = append(violations, fmt.Sprintf("%.3f%% of messages were lost, above the maximum of %v%%", loss, opts.MaxLoss))
+	}
+
+	if p99 := aggregate.latencies.percentile(99); opts.SloP99 > 0 && p99 > opts.SloP99 {
+		violations = append(violations, fmt.Sprintf("p99 latency of %v is above the slo of %v", p99, opts.SloP99))
+	}
+
+	return violations
+}
+
+func newReport(opts Config, results []Statistics, aggregate *Aggregate, verified bool, errors map[string]int) *Report {
+	// validated already
+	buckets, _ := parseBuckets(opts.Buckets)
+
+	report := &Report{
+		Connections: make([]ConnectionReport, 0, len(results)),
+		Aggregate: &AggregateReport{
+			ConnectionReport: toReport(&opts, &aggregate.Statistics, buckets),
+			Connect: ConnectReport{
+				MinMillis: millis(aggregate.minConnect),
+				AvgMillis: millis(aggregate.avgConnect()),
+				MaxMillis: millis(aggregate.maxConnect),
+				Reused:    aggregate.reused,
+			},
+			Connections:       aggregate.connections,
+			Topics:            aggregate.topics,
+			SessionsPresent:   aggregate.sessionsPresent,
+			Concurrency:       aggregate.concurrency,
+			AliasSavedBytes:   aggregate.aliasSaved,
+			FailedConnections: aggregate.failed,
+			Interrupted:       aggregate.interrupted,
+		},
+		Errors:    errors,
+		opts:      opts,
+		results:   results,
+		aggregate: aggregate,
+	}
+
+	for i := range results {
+		connection := toReport(&opts, &results[i], buckets)
+		if results[i].role.publishes() {
+			connection.TargetMBps = float64(opts.ByteRate) / 1e6
+		}
+
+		report.Connections = append(report.Connections, connection)
+	}
+
+	report.Aggregate.TargetMBps = float64(opts.ByteRate*aggregate.publishers) / 1e6
+	report.Topics, report.OtherTopics = aggregate.topicReports(), aggregate.perTopic.other
+
+	report.Violations = report.check(verified)
+	return report
+}
+
+func percentiles(h *histogram) *PercentileReport {
+	return &PercentileReport{
+		P50Micros: micros(h.percentile(50)),
+		P95Micros: micros(h.percentile(95)),
+		P99Micros: micros(h.percentile(99)),
+	}
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func toReport(opts *Config, s *Statistics, buckets []time.Duration) ConnectionReport {
+	report := ConnectionReport{
+		Id:             s.id,
+		Sent:           s.sent,
+		Received:       s.received,
+		Lost:           s.lost,
+		Discarded:      s.discarded,
+		Foreign:        s.foreign,
+		Duplicates:     len(s.duplicates),
+		Missing:        s.missing,
+		OutOfOrder:     s.reordered,
+		WrongTopic:     s.wrongTopics,
+		Uncorrelated:   s.uncorrelated,
+		DurationMillis: s.timeTaken.Milliseconds(),
+		TotalSize:      s.totalSize,
+		Throughput:     s.throughput(),
+		MBps:           s.mbps(),
+		Receive:        s.receiveThroughput(),
+		Latency: LatencyReport{
+			MinMicros: micros(s.minLatency),
+			AvgMicros: micros(s.avgLatency),
+			MaxMicros: micros(s.maxLatency),
+			P50Micros: micros(s.latencies.percentile(50)),
+			P95Micros: micros(s.latencies.percentile(95)),
+			P99Micros: micros(s.latencies.percentile(99)),
+		},
+		ConnectMillis:  millis(s.connectTime),
+		Reused:         s.reused,
+		SessionPresent: s.connack.sessionPresent,
+		AssignedID:     s.connack.assignedID,
+		LostSessions:   s.lostSessions,
+	}
+
+	if buckets != nil {
+		report.LatencyBuckets = bucketReports(s.latencies, buckets)
+	}
+
+	if opts.Churn > 0 {
+		report.Reconnects = &ReconnectReport{
+			Count:     s.reconnects.count(),
+			P50Millis: millis(s.reconnects.percentile(50)),
+			P95Millis: millis(s.reconnects.percentile(95)),
+			P99Millis: millis(s.reconnects.percentile(99)),
+		}
+	}
+
+	if opts.PayloadDist != "" {
+		report.PayloadMean = s.meanSize()
+		report.PayloadP99 = int64(s.sizes.percentile(99))
+	}
+
+	if opts.PubQos > 0 && s.acks.count() > 0 {
+		report.Ack = percentiles(s.acks)
+	}
+
+	if s.sends.count() > 0 {
+		report.Send = percentiles(s.sends)
+	}
+
+	if s.roundTrips.count() > 0 {
+		report.RoundTrip = percentiles(s.roundTrips)
+	}
+
+	if opts.Probe {
+		report.InterArrival = percentiles(s.arrivals)
+	}
+
+	return report
+}
+
+// WriteJSON writes the exported fields as indented json
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText writes the human readable results, a line per connection followed
+// by the aggregate
+func (r *Report) WriteText(w io.Writer) {
+	if r.Wills != nil {
+		wills := r.Wills
+		fmt.Fprintln(w, "Wills delivered =", wills.Delivered, "/", wills.Killed, ", Failed connections =", wills.FailedConnections)
+		fmt.Fprintln(w, "Will latency (p50/p95/p99) =", wills.latencies.percentile(50), "/", wills.latencies.percentile(95), "/", wills.latencies.percentile(99))
+		return
+	}
+
+	if churn := r.SubChurn; churn != nil {
+		fmt.Fprintln(w, "Connections =", churn.Connections, ", Subscribes =", churn.Subscribes, ", Unsubscribes =", churn.Unsubscribes, ", Failed =", churn.FailedOperations, ", Throughput (operations/sec) =", int64(churn.Throughput))
+		fmt.Fprintln(w, "Suback latency (p50/p95/p99) =", churn.subacks.percentile(50), "/", churn.subacks.percentile(95), "/", churn.subacks.percentile(99))
+		fmt.Fprintln(w, "Unsuback latency (p50/p95/p99) =", churn.unsubacks.percentile(50), "/", churn.unsubacks.percentile(95), "/", churn.unsubacks.percentile(99))
+		if churn.FailedConnections > 0 {
+			fmt.Fprintln(w, "Failed connections =", churn.FailedConnections, "of", churn.Connections+churn.FailedConnections)
+		}
+
+		return
+	}
+
+	opts, aggregate := &r.opts, r.aggregate
+	payload := strconv.Itoa(opts.PayloadSize)
+	if opts.PayloadDist != "" {
+		payload = opts.PayloadDist
+	}
+
+	// probes only know the latency of messages with the header
+	latency := !opts.Probe || opts.ProbeHeader
+	for _, s := range r.results {
+		if s.role == subscriber {
+			fmt.Fprintln(w, "Id =", s.id, ", Received =", s.received, ", Payload (bytes) =", payload, ", Receive throughput (messages/sec) =", int64(s.receiveThroughput()))
+		} else {
+			fmt.Fprintln(w, "Id =", s.id, ", Sent =", s.sent, ", Received =", s.received, ", Payload (bytes) =", payload, ", Throughput (messages/sec) =", int64(s.throughput()))
+		}
+
+		if s.role.subscribes() && latency {
+			fmt.Fprintln(w, "    Latency (min/avg/max) =", s.minLatency, "/", s.avgLatency, "/", s.maxLatency)
+		}
+	}
+
+	fmt.Fprintln(w, "Connections =", aggregate.connections, ", Topics =", aggregate.topics, ", Sent =", aggregate.sent, ", Received =", aggregate.received, ", Throughput (messages/sec) =", int64(aggregate.throughput()), ", Throughput (MB/sec) =", fmt.Sprintf("%.2f", aggregate.mbps()), ", Receive throughput (messages/sec) =", int64(aggregate.receiveThroughput()))
+	fmt.Fprintln(w, "Messages lost =", aggregate.lost)
+	if opts.Warmup > 0 {
+		fmt.Fprintln(w, "Messages discarded in warmup =", aggregate.discarded)
+	}
+
+	if aggregate.foreign > 0 {
+		fmt.Fprintln(w, "Foreign messages skipped =", aggregate.foreign, "(too short for the header)")
+	}
+
+	if opts.ByteRate > 0 {
+		// short of the target, the broker or the network is the bottleneck
+		fmt.Fprintln(w, "Byte rate (MB/sec) =", fmt.Sprintf("%.2f", aggregate.mbps()), "of a target of", fmt.Sprintf("%.2f", float64(opts.ByteRate*aggregate.publishers)/1e6))
+	}
+
+	if opts.PayloadDist != "" {
+		fmt.Fprintln(w, "Payload size (mean/p99) =", fmt.Sprintf("%.0f", aggregate.meanSize()), "/", int64(aggregate.sizes.percentile(99)), "bytes")
+	}
+
+	if opts.VerifyOrder {
+		fmt.Fprintln(w, "Out of order =", aggregate.reordered)
+	}
+
+	if opts.TopicAlias {
+		// of what the topics and payloads would have been without aliases
+		percent := 0.0
+		if total := aggregate.aliasTopics + int64(aggregate.totalSize); total > 0 {
+			percent = float64(aggregate.aliasSaved) * 100 / float64(total)
+		}
+
+		fmt.Fprintln(w, "Topic alias saved =", humanBytes(float64(aggregate.aliasSaved)), fmt.Sprintf("(%.1f%%)", percent), ", Wrong topic =", aggregate.wrongTopics)
+	}
+
+	if fanIn := r.FanIn; fanIn != nil {
+		fmt.Fprintln(w, "Fan in: Publishers =", fanIn.Publishers, ", Receive throughput (messages/sec) =", int64(fanIn.ReceiveRate), ", Max backlog =", fanIn.MaxBacklog, ", Seconds behind =", fanIn.SecondsBehind, "of", fanIn.Seconds)
+	}
+
+	if len(r.Topics) > 0 {
+		r.writeTopics(w)
+	}
+
+	if r.Burst != nil {
+		r.Burst.write(w)
+	}
+
+	if consume := r.Consume; consume != nil {
+		fmt.Fprintln(w, "Slow consumers: Delay =", opts.ConsumeDelay, ", Capacity (messages/sec) =", int64(consume.CapacityRate), ", Published (messages/sec) =", int64(consume.PublishRate), ", Delivered (messages/sec) =", int64(consume.DeliveryRate), ", Undelivered =", consume.Undelivered, ", Disconnects =", consume.Disconnects)
+	}
+
+	if shared := r.Shared; shared != nil {
+		fmt.Fprintln(w, "Shared group =", shared.Group, ", Members =", shared.Members, ", Received per member (min/max/stddev) =", shared.MinReceived, "/", shared.MaxReceived, "/", fmt.Sprintf("%.1f", shared.StddevReceived))
+	}
+
+	if opts.VerifyQos2 {
+		fmt.Fprintln(w, "Duplicates =", len(aggregate.duplicates), ", Missing =", aggregate.missing)
+	}
+
+	if opts.Churn > 0 {
+		h := aggregate.reconnects
+		fmt.Fprintln(w, "Reconnects =", h.count(), ", Reconnect time (p50/p95/p99) =", h.percentile(50), "/", h.percentile(95), "/", h.percentile(99))
+	}
+
+	if opts.Workers > 0 {
+		fmt.Fprintln(w, "Workers =", opts.Workers, ", Most connections publishing at once =", aggregate.concurrency)
+	}
+
+	if !opts.CleanSession {
+		fmt.Fprintln(w, "Sessions present =", aggregate.sessionsPresent, "of", aggregate.connections, "connections , Reconnects without their session =", aggregate.lostSessions)
+	}
+
+	if aggregate.reused > 0 {
+		fmt.Fprintln(w, "Connect time (min/avg/max) =", aggregate.minConnect, "/", aggregate.avgConnect(), "/", aggregate.maxConnect, ", Reused connections =", aggregate.reused)
+	} else {
+		fmt.Fprintln(w, "Connect time (min/avg/max) =", aggregate.minConnect, "/", aggregate.avgConnect(), "/", aggregate.maxConnect)
+	}
+	if latency {
+		fmt.Fprintln(w, "Latency (p50/p95/p99) =", aggregate.latencies.percentile(50), "/", aggregate.latencies.percentile(95), "/", aggregate.latencies.percentile(99))
+	}
+
+	if buckets := r.Aggregate.LatencyBuckets; latency && buckets != nil {
+		writeBuckets(w, buckets)
+	}
+
+	if opts.Probe {
+		h := aggregate.arrivals
+		fmt.Fprintln(w, "Inter-arrival (p50/p95/p99) =", h.percentile(50), "/", h.percentile(95), "/", h.percentile(99))
+	}
+
+	if opts.PubQos > 0 && !opts.Probe {
+		h := aggregate.acks
+		fmt.Fprintln(w, "Ack latency (p50/p95/p99) =", h.percentile(50), "/", h.percentile(95), "/", h.percentile(99))
+	}
+
+	if !opts.Probe {
+		h := aggregate.sends
+		fmt.Fprintln(w, "Send time (p50/p95/p99) =", h.percentile(50), "/", h.percentile(95), "/", h.percentile(99))
+	}
+
+	if opts.RoundTrip {
+		h := aggregate.roundTrips
+		fmt.Fprintln(w, "Responses =", h.count(), ", Uncorrelated =", aggregate.uncorrelated, ", Round trip (p50/p95/p99) =", h.percentile(50), "/", h.percentile(95), "/", h.percentile(99))
+	}
+
+	if rt := r.Runtime; rt != nil {
+		fmt.Fprintln(w, "Runtime: GOMAXPROCS =", rt.MaxProcs, "of", rt.CPUs, "cpus , Peak goroutines =", rt.PeakGoroutines, ", GCs =", rt.GCs, ", GC pause (total/max) =", fmt.Sprintf("%.2fms / %.2fms", rt.GCPauseMillis, rt.MaxPauseMillis), ", GC cpu =", fmt.Sprintf("%.1f%%", rt.GCCPUPercent))
+	}
+
+	if len(r.Errors) > 0 {
+		kinds := make([]string, 0, len(r.Errors))
+		for kind := range r.Errors {
+			kinds = append(kinds, kind)
+		}
+
+		sort.Strings(kinds)
+		counts := make([]string, 0, len(kinds))
+		for _, kind := range kinds {
+			counts = append(counts, fmt.Sprintf("%v: %v", kind, r.Errors[kind]))
+		}
+
+		fmt.Fprintln(w, "Errors =", strings.Join(counts, ", "))
+	}
+
+	if aggregate.interrupted {
+		fmt.Fprintln(w, "Interrupted, results are partial")
+	}
+
+	if aggregate.failed > 0 {
+		fmt.Fprintln(w, "Failed connections =", aggregate.failed, "of", aggregate.connections+aggregate.failed, ", results are partial")
+	}
+}
+
+// AppendCSV appends one row per connection to the file at path. The header is
+// only written when the file is new so that runs accumulate in one file. With
+// Config.Buckets, a column per latency bucket follows
+func (r *Report) AppendCSV(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// validated already
+	buckets, _ := parseBuckets(r.opts.Buckets)
+	columns := []string{"id", "total_messages", "duration_seconds", "total_size_bytes", "throughput_mbps"}
+	if buckets != nil {
+		for _, b := range bucketReports(new(histogram), buckets) {
+			columns = append(columns, b.column())
+		}
+	}
+
+	// rows are only appended under the same columns, which other
+	// --latency-buckets would change
+	header, err := csv.NewReader(file).Read()
+	switch {
+	case err == io.EOF:
+		header = nil
+	case err != nil:
+		return fmt.Errorf("read the header of %v: %v", path, err)
+	case !slices.Equal(header, columns):
+		return fmt.Errorf("%v has the columns %v, not the %v of this run", path, strings.Join(header, ","), strings.Join(columns, ","))
+	}
+
+	w := csv.NewWriter(file)
+	if header == nil {
+		w.Write(columns)
+	}
+
+	for i := range r.results {
+		s := &r.results[i]
+		row := []string{
+			s.id,
+			strconv.Itoa(s.sent),
+			strconv.FormatFloat(s.timeTaken.Seconds(), 'f', 3, 64),
+			strconv.Itoa(s.totalSize),
+			strconv.FormatFloat(s.mbps(), 'f', 3, 64),
+		}
+
+		if buckets != nil {
+			for _, b := range bucketReports(s.latencies, buckets) {
+				row = append(row, strconv.FormatUint(b.Count, 10))
+			}
+		}
+
+		w.Write(row)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
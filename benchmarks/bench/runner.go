@@ -0,0 +1,606 @@
+// Package bench benchmarks mqtt brokers with paho clients. Connections
+// publish timestamped, sequenced messages and subscribers measure the latency
+// and loss of what the broker delivers
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Runner runs benchmarks described by a Config. A runner runs one benchmark
+// at a time, but can be run again for multi phase benchmarks
+type Runner struct {
+	opts Config
+	// brokers is the parsed form of Config.Broker
+	brokers []string
+	// fileData holds the contents of Config.PayloadFile
+	fileData []byte
+	// sizes is the parsed form of Config.PayloadDist. nil without it
+	sizes *distribution
+	// burst is the parsed form of Config.Burst. nil without it
+	burst *schedule
+	// seed is Config.Seed, or the one picked without it. The template payload
+	// is generated from it and every connection has a source derived from it
+	seed int64
+	// wsHeaders is the parsed form of Config.WsHeader
+	wsHeaders http.Header
+	// tlsConfig is built from the tls options. nil when none of them are set
+	tlsConfig *tls.Config
+	// dialer opens network connections, through Config.Proxy when set
+	dialer proxy.Dialer
+	// clientPrefix is Config.ClientPrefix with the host name appended, so that
+	// runs from different hosts don't take over each other's connections. It is
+	// stable across runs, for CleanSession false to resume sessions
+	clientPrefix string
+	// warmupEnd is when measurement starts, in unix nanoseconds. Messages
+	// stamped before it are discarded by subscribers, which can get messages
+	// while it is set
+	warmupEnd atomic.Int64
+	metrics   *metrics
+	log       *slog.Logger
+	// errs carries the failures of connections to collect, which answers
+	// tally with the counts of each kind
+	errs  chan error
+	tally chan chan map[string]int
+	// closed stops collect on Close. Runners sharing another's collector
+	// leave closing it to the other
+	closed  chan struct{}
+	sharing bool
+	// aliasBytes is what Config.TopicAlias saved in the current run
+	aliasBytes aliasBytes
+	// fanIn tracks the subscriber of Config.FanIn in the current run. nil
+	// without it
+	fanIn *fanIn
+	// active is the number of connections publishing with Config.Workers,
+	// and peakActive the most at once in the current run
+	active, peakActive atomic.Int64
+	// pool holds the clients the phases of a scenario pass on with
+	// Config.ReuseConns. nil otherwise
+	pool *pool
+}
+
+// NewRunner validates config and prepares a runner for it
+func NewRunner(config Config) (*Runner, error) {
+	// room for bursts of failures, like a broker dropping every connection,
+	// without holding up the connections reporting them
+	r := &Runner{opts: config, metrics: new(metrics), errs: make(chan error, 1024), tally: make(chan chan map[string]int), closed: make(chan struct{})}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	go r.collect()
+	return r, nil
+}
+
+// Close stops the runner once it is done with. It can't be run after
+func (r *Runner) Close() {
+	if !r.sharing {
+		close(r.closed)
+	}
+}
+
+// measureStart is warmupEnd as a time
+func (r *Runner) measureStart() time.Time {
+	return time.Unix(0, r.warmupEnd.Load())
+}
+
+// Logger is where the runner logs diagnostics, Config.Logger or the default
+// one
+func (r *Runner) Logger() *slog.Logger {
+	return r.log
+}
+
+// Run runs the benchmark. When ctx is done the run stops early and the report
+// holds the partial results. Errors are for runs which couldn't measure
+// anything, like when every connection fails
+func (r *Runner) Run(ctx context.Context) (*Report, error) {
+	opts := &r.opts
+	if opts.MetricsAddr != "" {
+		server := r.metrics.serve(opts.MetricsAddr, r.log)
+		defer server.Shutdown(context.Background())
+	}
+
+	// the process may go on with other runners, like the phases of a
+	// scenario
+	if opts.MaxProcs > 0 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(opts.MaxProcs))
+	}
+
+	if opts.Aggregator != "" {
+		return r.aggregateSenders(ctx)
+	}
+
+	if opts.TestWill {
+		return r.testWills(ctx)
+	}
+
+	if opts.SubChurn {
+		return r.churnSubscriptions(ctx)
+	}
+
+	// only this run's failures and aliases
+	r.failures()
+	r.aliasBytes.saved.Store(0)
+	r.aliasBytes.topics.Store(0)
+	r.peakActive.Store(0)
+
+	var sink *sink
+	if opts.Sink != "" {
+		sink = r.joinSink()
+		defer sink.close()
+	}
+
+	// subscribe all the connections before anyone publishes. With --sub-delay
+	// the subscribers only connect once publishers are done, and get the
+	// retained messages
+	specs, late := r.plan(), []spec(nil)
+	if r.pool != nil {
+		r.pool.keep(specs, opts.SubQos)
+	}
+
+	if opts.SubDelay {
+		specs, late = specs[:opts.PubConns], specs[opts.PubConns:]
+	}
+
+	if opts.FanIn {
+		r.fanIn = newFanIn(r.metrics)
+	}
+
+	connections, failed := r.connectAll(ctx, specs)
+	if len(connections) == 0 {
+		return nil, fmt.Errorf("all %v connections failed", failed)
+	}
+
+	// every subscriber receives what all the publishers on its topic send
+	publishers := make(map[string]int)
+	for _, connection := range connections {
+		if connection.role.publishes() {
+			publishers[connection.topic]++
+		}
+	}
+
+	r.expectAll(connections, publishers)
+	topics := len(publishers) * opts.Topics
+
+	runCtx := ctx
+	if opts.Duration > 0 {
+		var stop context.CancelFunc
+		runCtx, stop = context.WithTimeout(ctx, opts.Warmup+opts.Duration)
+		defer stop()
+	}
+
+	stopSampling := make(chan struct{})
+	sampled := make(chan error, 1)
+	if opts.Timeseries != "" {
+		go func() { sampled <- r.writeTimeseries(opts.Timeseries, stopSampling) }()
+	} else {
+		sampled <- nil
+	}
+
+	if opts.ReportEvery > 0 {
+		go r.snapshot(opts.ReportEvery, stopSampling)
+	}
+
+	sampledRuntime := make(chan *RuntimeReport, 1)
+	if opts.RuntimeStats {
+		go sampleRuntime(stopSampling, sampledRuntime)
+	} else {
+		sampledRuntime <- nil
+	}
+
+	watched := make(chan struct{})
+	if r.fanIn != nil {
+		go r.fanIn.watch(stopSampling, watched)
+	} else {
+		close(watched)
+	}
+
+	template := r.newPayload()
+	r.warmupEnd.Store(time.Now().Add(opts.Warmup).UnixNano())
+	results := r.run(runCtx, connections, template)
+	if len(late) > 0 && ctx.Err() == nil {
+		subscribers, n := r.connectAll(ctx, late)
+		failed += n
+		r.expectAll(subscribers, publishers)
+		results = append(results, r.run(ctx, subscribers, template)...)
+	}
+
+	close(stopSampling)
+	if err := <-sampled; err != nil {
+		r.log.Error("failed to write timeseries", "err", err)
+	}
+
+	<-watched
+	runtimeReport := <-sampledRuntime
+
+	aggregate := newAggregate()
+	aggregate.failed, aggregate.topics = failed, topics
+	for _, s := range results {
+		aggregate.add(s)
+	}
+
+	aggregate.interrupted = ctx.Err() != nil
+	aggregate.concurrency = int(r.peakActive.Load())
+	aggregate.aliasSaved, aggregate.aliasTopics = r.aliasBytes.saved.Load(), r.aliasBytes.topics.Load()
+	var shared *SharedReport
+	if opts.SharedGroup != "" {
+		shared = r.shareOut(results)
+		aggregate.lost = shared.Lost
+	}
+
+	verified := !opts.VerifyQos2 || r.verify(results)
+	report := newReport(*opts, results, &aggregate, verified, r.failures())
+	if shared != nil {
+		report.Shared = shared
+		report.Violations = append(report.Violations, shared.check()...)
+	}
+
+	if r.fanIn != nil {
+		report.FanIn = r.fanIn.report(results, &aggregate)
+	}
+
+	if r.burst != nil {
+		report.Burst = newBurstReport(r.burst, aggregate.bursts)
+	}
+
+	if opts.ConsumeDelay > 0 {
+		report.Consume = newConsumeReport(opts, results, &aggregate, report.Errors)
+	}
+
+	report.Runtime = runtimeReport
+	if sink != nil {
+		if err := sink.send(results, &aggregate, report.Errors); err != nil {
+			r.log.Error("failed to send the results to the sink", "sink", opts.Sink, "err", err)
+		}
+	}
+
+	return report, nil
+}
+
+// failures returns the counts of each kind of failure since the last call
+func (r *Runner) failures() map[string]int {
+	reply := make(chan map[string]int)
+	r.tally <- reply
+	return <-reply
+}
+
+// verify logs the anomalies found by --verify-qos2 and reports whether there
+// were none
+func (r *Runner) verify(results []Statistics) bool {
+	// enough to see a pattern without flooding the terminal
+	const shown = 10
+	ok := true
+	report := func(id, kind string, anomalies []string) {
+		for i, anomaly := range anomalies {
+			if i == shown {
+				r.log.Warn("more "+kind, "id", id, "count", len(anomalies)-shown)
+				break
+			}
+
+			r.log.Warn(kind, "id", id, "message", anomaly)
+		}
+	}
+
+	for _, s := range results {
+		report(s.id, "duplicate", s.duplicates)
+		report(s.id, "missing", s.missingSequences)
+		if len(s.duplicates) > 0 || s.missing > 0 {
+			ok = false
+			r.log.Warn("qos 2 not exactly once", "id", s.id, "duplicates", len(s.duplicates), "missing", s.missing)
+		}
+	}
+
+	if ok {
+		r.log.Info("qos 2 verified, every message was delivered exactly once")
+	}
+
+	return ok
+}
+
+// connectAll opens the connections in specs, spread over --ramp. Returns the
+// ones which connected and the number which failed
+func (r *Runner) connectAll(ctx context.Context, specs []spec) ([]*connection, int) {
+	connections := make([]*connection, 0, len(specs))
+	failed := 0
+	delay := r.opts.Ramp / time.Duration(len(specs))
+	for i, spec := range specs {
+		if i > 0 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		total := r.opts.Messages
+		if r.opts.Duration > 0 {
+			total = 0
+		}
+
+		connection, err := newConnection(r, spec, total)
+		if err != nil {
+			r.log.Warn("connection failed", "id", spec.id, "err", err)
+			failed++
+			continue
+		}
+
+		connections = append(connections, connection)
+	}
+
+	return connections, failed
+}
+
+// expectAll sets how many messages each connection should receive, given the
+// number of publishers on each topic
+func (r *Runner) expectAll(connections []*connection, publishers map[string]int) {
+	for _, connection := range connections {
+		// with Config.Topics subscriptions to topic/+ get everything published
+		// under the topic
+		filter := connection.filter
+		if r.opts.Topics > 1 {
+			filter = connection.topic
+		}
+
+		count, topics := matching(publishers, filter)
+		switch {
+		case !connection.role.subscribes():
+			connection.expect(0)
+		case r.opts.SubDelay:
+			// only the last retained message of each topic
+			connection.expect(topics * min(r.opts.Topics, r.opts.Messages))
+		case r.opts.Duration > 0 || r.opts.SharedGroup != "":
+			// how the broker shares out the messages isn't known upfront
+			connection.expect(-1)
+		default:
+			connection.expect(r.opts.Messages * count)
+		}
+	}
+}
+
+// matching counts the publishers and the topics with publishers which filter
+// matches
+func matching(publishers map[string]int, filter string) (count, topics int) {
+	for topic, n := range publishers {
+		if matches(filter, topic) {
+			count += n
+			topics++
+		}
+	}
+
+	return count, topics
+}
+
+// matches reports whether topic matches the subscription filter, where + is
+// any one level and # any number of remaining levels. Wildcards at the first
+// level don't match topics starting with $, like $SYS
+func matches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filters, levels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(levels) || (f != "+" && f != levels[i]) {
+			return false
+		}
+	}
+
+	return len(filters) == len(levels)
+}
+
+// run starts the connections and waits for all of them to report
+func (r *Runner) run(ctx context.Context, connections []*connection, template []byte) []Statistics {
+	// drained is closed once every publisher is done, after which subscribers
+	// stop waiting when messages stop arriving
+	published := new(sync.WaitGroup)
+	drained := make(chan struct{})
+	for _, connection := range connections {
+		if connection.role.publishes() {
+			published.Add(1)
+		}
+	}
+
+	// probes listen for the whole run, there isn't an end of publishing to
+	// drain after
+	if !r.opts.Probe {
+		go func() {
+			published.Wait()
+			close(drained)
+		}()
+	}
+
+	if r.opts.Workers > 0 {
+		return r.runWorkers(ctx, connections, template, published, drained)
+	}
+
+	// room for every connection's report, so none of them block on a reader
+	// which is behind
+	stats := make(chan Statistics, len(connections))
+	for _, connection := range connections {
+		go connection.Start(ctx, template, published, drained, stats)
+	}
+
+	results := make([]Statistics, 0, len(connections))
+	for range connections {
+		results = append(results, <-stats)
+	}
+
+	return results
+}
+
+// spec describes a connection to open
+type spec struct {
+	id     string
+	index  uint32
+	broker string
+	topic  string
+	filter string
+	role   role
+}
+
+// plan lists the connections to open. -c opens loopback connections while
+// --pub-conns and --sub-conns open separate publishers and subscribers
+func (r *Runner) plan() []spec {
+	var specs []spec
+	opts := &r.opts
+	if opts.Probe {
+		for i := 0; i < opts.Connections; i++ {
+			specs = append(specs, spec{fmt.Sprintf("%v-probe-%d", r.clientPrefix, i), uint32(i), r.brokers[i%len(r.brokers)], r.topic(i), r.filter(i), subscriber})
+		}
+
+		return specs
+	}
+
+	if opts.PubConns == 0 {
+		for i := 0; i < opts.Connections; i++ {
+			specs = append(specs, spec{fmt.Sprintf("%v-%d", r.clientPrefix, i), uint32(i), r.brokers[i%len(r.brokers)], r.topic(i), r.filter(i), loopback})
+		}
+
+		return specs
+	}
+
+	for i := 0; i < opts.PubConns; i++ {
+		specs = append(specs, spec{fmt.Sprintf("%v-pub-%d", r.clientPrefix, i), uint32(i), "", r.topic(i), "", publisher})
+	}
+
+	for i := 0; i < opts.SubConns; i++ {
+		specs = append(specs, spec{fmt.Sprintf("%v-sub-%d", r.clientPrefix, i), uint32(i), "", r.topic(i % opts.PubConns), r.filter(i % opts.PubConns), subscriber})
+	}
+
+	for i := range specs {
+		specs[i].broker = r.brokers[i%len(r.brokers)]
+	}
+
+	return specs
+}
+
+// topic resolves the %d placeholder in Config.Topic for the given connection
+func (r *Runner) topic(index int) string {
+	return strings.Replace(r.opts.Topic, "%d", strconv.Itoa(index), -1)
+}
+
+// filter is the subscription of the given connection, the resolved
+// Config.SubTopic or the published topic without it. topic/+ with
+// Config.Topics
+func (r *Runner) filter(index int) string {
+	if r.opts.SubTopic == "" && r.opts.Topics > 1 {
+		return r.topic(index) + "/+"
+	}
+
+	if r.opts.SubTopic == "" {
+		return r.topic(index)
+	}
+
+	return strings.Replace(r.opts.SubTopic, "%d", strconv.Itoa(index), -1)
+}
+
+// newPayload returns the message to publish, with room for the header at the
+// start
+func (r *Runner) newPayload() []byte {
+	if r.fileData == nil {
+		return data(rand.New(rand.NewSource(r.seed)), r.opts.PayloadSize)
+	}
+
+	b := make([]byte, headerSize+len(r.fileData))
+	copy(b[headerSize:], r.fileData)
+	return b
+}
+
+func data(rng *rand.Rand, n int) []byte {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rng.Intn(len(letterBytes))]
+	}
+
+	return b
+}
+
+// writeTimeseries samples the received messages counter every second, till
+// stop is closed, and writes a timestamp,messages_this_second row for each.
+// Rows are flushed as they are sampled so that a run can be watched live
+func (r *Runner) writeTimeseries(path string, stop chan struct{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"timestamp", "messages_this_second"})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	last := atomic.LoadUint64(&r.metrics.received)
+	for {
+		select {
+		case now := <-ticker.C:
+			received := atomic.LoadUint64(&r.metrics.received)
+			w.Write([]string{strconv.FormatInt(now.Unix(), 10), strconv.FormatUint(received-last, 10)})
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return err
+			}
+
+			last = received
+		case <-stop:
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return err
+			}
+
+			return file.Close()
+		}
+	}
+}
+
+// snapshot logs the aggregate rates since the previous snapshot and the
+// connections up, every interval till stop is closed. It shows whether the
+// broker keeps up during long runs
+func (r *Runner) snapshot(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m := r.metrics
+	sent, received, bytes := atomic.LoadUint64(&m.sent), atomic.LoadUint64(&m.received), atomic.LoadUint64(&m.sentBytes)
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		nowSent, nowReceived, nowBytes := atomic.LoadUint64(&m.sent), atomic.LoadUint64(&m.received), atomic.LoadUint64(&m.sentBytes)
+		seconds := interval.Seconds()
+		r.log.Info("progress",
+			"sent_per_sec", int64(float64(nowSent-sent)/seconds),
+			"received_per_sec", int64(float64(nowReceived-received)/seconds),
+			"mb_per_sec", fmt.Sprintf("%.2f", float64(nowBytes-bytes)/seconds/1e6),
+			"active", atomic.LoadInt64(&m.active))
+		sent, received, bytes = nowSent, nowReceived, nowBytes
+	}
+}
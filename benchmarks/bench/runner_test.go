@@ -0,0 +1,67 @@
+package bench
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/b", "a/b", true},
+		{"+/+", "a/b", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+", "", true},
+		{"a/+/c", "a//c", true},
+		// wildcards at the first level don't match $ topics
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"+", "$SYS", false},
+		{"$SYS/#", "$SYS/x", true},
+		{"$SYS/+", "$SYS/x", true},
+		{"a/#", "a/$x", true},
+	}
+
+	for _, test := range tests {
+		if got := matches(test.filter, test.topic); got != test.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := &Runner{log: slog.New(slog.NewTextHandler(io.Discard, nil)), errs: make(chan error), tally: make(chan chan map[string]int), closed: make(chan struct{})}
+	collected := make(chan struct{})
+	go func() {
+		r.collect()
+		close(collected)
+	}()
+
+	r.fail("a", publishFailed, errors.New("refused"))
+	if got := r.failures()[publishFailed]; got != 1 {
+		t.Errorf("failures = %v, want 1", got)
+	}
+
+	r.Close()
+	select {
+	case <-collected:
+	case <-time.After(time.Second):
+		t.Fatal("collect didn't return once the runner was closed")
+	}
+
+	// nothing collects the failures of clients left behind
+	r.fail("a", disconnected, errors.New("closed"))
+}
@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"runtime"
+	"time"
+)
+
+// RuntimeReport describes the load on the benchmark's own process, for
+// Config.RuntimeStats. Many goroutines per cpu or long gc pauses mean the
+// client, not the broker, limits the results
+type RuntimeReport struct {
+	MaxProcs       int     `json:"gomaxprocs"`
+	CPUs           int     `json:"cpus"`
+	PeakGoroutines int     `json:"peak_goroutines"`
+	GCs            uint32  `json:"gcs"`
+	GCPauseMillis  float64 `json:"gc_pause_total_ms"`
+	MaxPauseMillis float64 `json:"gc_pause_max_ms"`
+	// GCCPUPercent is the share of the process's cpu time spent in gc since
+	// it started
+	GCCPUPercent float64 `json:"gc_cpu_percent"`
+}
+
+// sampleRuntime tracks the peak number of goroutines till stop is closed,
+// then reports it with the garbage collections since the start
+func sampleRuntime(stop chan struct{}, report chan *RuntimeReport) {
+	var start runtime.MemStats
+	runtime.ReadMemStats(&start)
+	peak := runtime.NumGoroutine()
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			running = false
+		}
+
+		peak = max(peak, runtime.NumGoroutine())
+	}
+
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	r := &RuntimeReport{
+		MaxProcs:       runtime.GOMAXPROCS(0),
+		CPUs:           runtime.NumCPU(),
+		PeakGoroutines: peak,
+		GCs:            end.NumGC - start.NumGC,
+		GCPauseMillis:  millis(time.Duration(end.PauseTotalNs - start.PauseTotalNs)),
+		GCCPUPercent:   end.GCCPUFraction * 100,
+	}
+
+	// PauseNs is a ring of the most recent pauses, pause i at i%256
+	n := uint32(len(end.PauseNs))
+	first := start.NumGC
+	if end.NumGC-first > n {
+		first = end.NumGC - n
+	}
+
+	for i := first; i < end.NumGC; i++ {
+		r.MaxPauseMillis = max(r.MaxPauseMillis, millis(time.Duration(end.PauseNs[i%n])))
+	}
+
+	report <- r
+}
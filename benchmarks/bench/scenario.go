@@ -0,0 +1,242 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a multi phase benchmark, like a ramp up, a hold, a spike and a
+// drain, loaded from a yaml file with LoadScenario:
+//
+//	phases:
+//	  - name: ramp
+//	    connections: 100
+//	    ramp: 30s
+//	    duration: 60s
+//	    rate: 10
+//	  - name: spike
+//	    connections: 1000
+//	    messages: 1000
+//	    pub_qos: 0
+type Scenario struct {
+	Phases []Phase `yaml:"phases"`
+}
+
+// Phase overrides the base config of a scenario for one run. Fields left out
+// keep the base value. A phase with messages but no duration publishes that
+// many messages even when the base runs for a duration
+type Phase struct {
+	Name        string        `yaml:"name"`
+	Connections int           `yaml:"connections"`
+	PubConns    int           `yaml:"pub_conns"`
+	SubConns    int           `yaml:"sub_conns"`
+	Messages    int           `yaml:"messages"`
+	Duration    time.Duration `yaml:"duration"`
+	Rate        int           `yaml:"rate"`
+	Ramp        time.Duration `yaml:"ramp"`
+	PayloadSize int           `yaml:"payload_size"`
+	// pointers as QoS 0 is a value to set
+	PubQos *int `yaml:"pub_qos"`
+	SubQos *int `yaml:"sub_qos"`
+}
+
+// LoadScenario reads the scenario in the yaml file at path
+func LoadScenario(path string) (*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	scenario := new(Scenario)
+	if err := decoder.Decode(scenario); err != nil {
+		return nil, fmt.Errorf("scenario %v: %v", path, err)
+	}
+
+	if len(scenario.Phases) == 0 {
+		return nil, fmt.Errorf("scenario %v has no phases", path)
+	}
+
+	for i := range scenario.Phases {
+		if scenario.Phases[i].Name == "" {
+			scenario.Phases[i].Name = fmt.Sprintf("phase-%d", i+1)
+		}
+	}
+
+	return scenario, nil
+}
+
+// apply returns base with the phase's overrides
+func (p *Phase) apply(base Config) Config {
+	config := base
+	config.Scenario = ""
+	if p.Connections > 0 {
+		config.Connections = p.Connections
+	}
+
+	if p.PubConns > 0 || p.SubConns > 0 {
+		config.PubConns, config.SubConns = p.PubConns, p.SubConns
+	}
+
+	if p.Messages > 0 {
+		config.Messages = p.Messages
+		config.Duration = 0
+	}
+
+	if p.Duration > 0 {
+		config.Duration = p.Duration
+	}
+
+	if p.Rate > 0 {
+		config.Rate = p.Rate
+	}
+
+	if p.Ramp > 0 {
+		config.Ramp = p.Ramp
+	}
+
+	if p.PayloadSize > 0 {
+		config.PayloadSize = p.PayloadSize
+	}
+
+	if p.PubQos != nil {
+		config.PubQos = *p.PubQos
+	}
+
+	if p.SubQos != nil {
+		config.SubQos = *p.SubQos
+	}
+
+	return config
+}
+
+// ScenarioReport holds the report of every phase and one combining them, with
+// the aggregate over the span of the whole scenario and no connections
+type ScenarioReport struct {
+	Phases   []PhaseReport `json:"phases"`
+	Combined *Report       `json:"combined"`
+}
+
+type PhaseReport struct {
+	Name string `json:"name"`
+	*Report
+}
+
+// OK is false when any phase failed
+func (r *ScenarioReport) OK() bool {
+	return r.Combined.OK()
+}
+
+// RunScenario runs the phases of scenario one after another, each with base
+// overridden by the phase. Every phase is validated before the first one
+// starts, so that a typo in the last phase doesn't waste the run. When ctx is
+// done the current phase stops early and the rest are skipped. A phase which
+// fails ends the scenario, with the report of the phases before it
+func RunScenario(ctx context.Context, base Config, scenario *Scenario) (*ScenarioReport, error) {
+	runners := make([]*Runner, len(scenario.Phases))
+	defer func() {
+		for _, runner := range runners {
+			if runner != nil {
+				runner.Close()
+			}
+		}
+	}()
+
+	for i := range scenario.Phases {
+		phase := &scenario.Phases[i]
+		config := phase.apply(base)
+		if config.TestWill || config.SubChurn {
+			return nil, errors.New("scenarios can't test wills or churn subscriptions")
+		}
+
+		var runner *Runner
+		var err error
+		if base.ReuseConns && i > 0 {
+			runner, err = newSharingRunner(config, runners[0])
+		} else {
+			runner, err = NewRunner(config)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("phase %v: %v", phase.Name, err)
+		}
+
+		runners[i] = runner
+	}
+
+	if base.ReuseConns {
+		pool := newPool()
+		defer pool.close()
+		for _, runner := range runners {
+			runner.pool = pool
+		}
+	}
+
+	report := new(ScenarioReport)
+	combined := newAggregate()
+	var violations []string
+	errs := make(map[string]int)
+	var err error
+	for i, runner := range runners {
+		if ctx.Err() != nil {
+			break
+		}
+
+		name := scenario.Phases[i].Name
+		runner.log.Info("starting phase", "phase", name)
+		phase, phaseErr := runner.Run(ctx)
+		if phaseErr != nil {
+			err = fmt.Errorf("phase %v: %v", name, phaseErr)
+			break
+		}
+
+		report.Phases = append(report.Phases, PhaseReport{Name: name, Report: phase})
+		for _, s := range phase.results {
+			combined.add(s)
+		}
+
+		combined.failed += phase.aggregate.failed
+		combined.topics = max(combined.topics, phase.aggregate.topics)
+		for kind, n := range phase.Errors {
+			errs[kind] += n
+		}
+
+		for _, violation := range phase.Violations {
+			violations = append(violations, name+": "+violation)
+		}
+	}
+
+	combined.interrupted = ctx.Err() != nil
+	// the connections are in the phase reports
+	report.Combined = newReport(base, nil, &combined, true, errs)
+	report.Combined.Violations = violations
+	return report, err
+}
+
+// WriteJSON writes the phases and the combined report as indented json
+func (r *ScenarioReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText writes the results of every phase followed by the combined ones
+func (r *ScenarioReport) WriteText(w io.Writer) {
+	for _, phase := range r.Phases {
+		fmt.Fprintln(w, "Phase", phase.Name)
+		phase.WriteText(w)
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "All phases")
+	r.Combined.WriteText(w)
+}
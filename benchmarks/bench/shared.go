@@ -0,0 +1,90 @@
+package bench
+
+import (
+	"fmt"
+	"math"
+)
+
+// SharedReport describes how the broker shared out the messages among the
+// members of Config.SharedGroup
+type SharedReport struct {
+	Group   string `json:"group"`
+	Members int    `json:"members"`
+	// Expected is the number of messages published to the group's filters,
+	// each of which should be delivered to exactly one member
+	Expected       int     `json:"expected"`
+	Received       int     `json:"received"`
+	Lost           int     `json:"lost"`
+	MinReceived    int     `json:"min_received"`
+	MaxReceived    int     `json:"max_received"`
+	StddevReceived float64 `json:"stddev_received"`
+}
+
+// subscription is the subscription for filter, in Config.SharedGroup when set
+func (r *Runner) subscription(filter string) string {
+	if r.opts.SharedGroup == "" {
+		return filter
+	}
+
+	return "$share/" + r.opts.SharedGroup + "/" + filter
+}
+
+// shareOut sums up what the members of the shared group received against
+// what was published to their filters
+func (r *Runner) shareOut(results []Statistics) *SharedReport {
+	report := &SharedReport{Group: r.opts.SharedGroup}
+	filters := make(map[string]bool)
+	var counts []int
+	for _, s := range results {
+		if !s.role.subscribes() {
+			continue
+		}
+
+		// with Config.Topics subscriptions to topic/+ get everything
+		// published under the topic
+		filter := s.filter
+		if r.opts.Topics > 1 {
+			filter = s.topic
+		}
+
+		filters[filter] = true
+		counts = append(counts, s.received)
+		report.Received += s.received
+	}
+
+	for filter := range filters {
+		for _, s := range results {
+			if s.role.publishes() && matches(filter, s.topic) {
+				report.Expected += s.sent
+			}
+		}
+	}
+
+	report.Members = len(counts)
+	if report.Members == 0 {
+		return report
+	}
+
+	report.Lost = max(report.Expected-report.Received, 0)
+	report.MinReceived, report.MaxReceived = counts[0], counts[0]
+	mean := float64(report.Received) / float64(report.Members)
+	variance := 0.0
+	for _, n := range counts {
+		report.MinReceived = min(report.MinReceived, n)
+		report.MaxReceived = max(report.MaxReceived, n)
+		variance += (float64(n) - mean) * (float64(n) - mean)
+	}
+
+	report.StddevReceived = math.Sqrt(variance / float64(report.Members))
+	return report
+}
+
+// check flags brokers which broadcast to the group instead of sharing out.
+// Probes don't know what was published
+func (s *SharedReport) check() []string {
+	if s.Expected == 0 || s.Received <= s.Expected {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("shared group %v received %v messages of %v published, they weren't shared out", s.Group, s.Received, s.Expected)}
+}
@@ -0,0 +1,298 @@
+package bench
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// sinkLine is one json line from a --results-sink sender to the aggregator.
+// A sender says hello when its run starts, sends a connection line for every
+// connection once it is over, then done
+type sinkLine struct {
+	Hello      *sinkHello      `json:"hello,omitempty"`
+	Connection *wireStatistics `json:"connection,omitempty"`
+	Done       *sinkDone       `json:"done,omitempty"`
+}
+
+type sinkHello struct {
+	Sender string `json:"sender"`
+	// Config is the sender's, without the credentials. The aggregator reports
+	// with the config of the first sender done
+	Config Config `json:"config"`
+}
+
+// sinkDone is what the sender knows of the run beyond its connections
+type sinkDone struct {
+	Failed      int            `json:"failed_connections"`
+	Interrupted bool           `json:"interrupted"`
+	Concurrency int            `json:"concurrency"`
+	AliasSaved  int64          `json:"topic_alias_saved_bytes"`
+	AliasTopics int64          `json:"topic_alias_topic_bytes"`
+	Errors      map[string]int `json:"errors"`
+}
+
+// sink streams the results of a run to the aggregator at Config.Sink
+type sink struct {
+	conn    net.Conn
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// joinSink connects to the aggregator and says hello. A run goes ahead
+// without the aggregator when it can't be reached, its results are only
+// printed then
+func (r *Runner) joinSink() *sink {
+	conn, err := net.DialTimeout("tcp", r.opts.Sink, 5*time.Second)
+	if err != nil {
+		r.log.Error("failed to connect to the results sink, the results won't be sent", "sink", r.opts.Sink, "err", err)
+		return nil
+	}
+
+	config := r.opts
+	config.Username, config.Password, config.Logger = "", "", nil
+	s := &sink{conn: conn, writer: bufio.NewWriter(conn)}
+	s.encoder = json.NewEncoder(s.writer)
+	if err := s.write(sinkLine{Hello: &sinkHello{Sender: r.clientPrefix, Config: config}}); err != nil {
+		r.log.Error("failed to join the results sink", "sink", r.opts.Sink, "err", err)
+		conn.Close()
+		return nil
+	}
+
+	r.log.Info("joined the results sink", "sink", r.opts.Sink)
+	return s
+}
+
+// send sends the statistics of every connection and the rest of the run
+func (s *sink) send(results []Statistics, aggregate *Aggregate, errors map[string]int) error {
+	for i := range results {
+		if err := s.write(sinkLine{Connection: toWire(&results[i])}); err != nil {
+			return err
+		}
+	}
+
+	done := &sinkDone{
+		Failed:      aggregate.failed,
+		Interrupted: aggregate.interrupted,
+		Concurrency: aggregate.concurrency,
+		AliasSaved:  aggregate.aliasSaved,
+		AliasTopics: aggregate.aliasTopics,
+		Errors:      errors,
+	}
+
+	return s.write(sinkLine{Done: done})
+}
+
+// close leaves the sink, which the aggregator takes as the sender being done
+// only after its done line. Nothing without a sink
+func (s *sink) close() {
+	if s != nil {
+		s.conn.Close()
+	}
+}
+
+// write sends line right away, so that the aggregator sees senders join
+func (s *sink) write(line sinkLine) error {
+	s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if err := s.encoder.Encode(line); err != nil {
+		return err
+	}
+
+	return s.writer.Flush()
+}
+
+// wireStatistics is Statistics on the wire, with what the aggregator needs to
+// merge connections as if they ran on one host. Histograms are sparse, index
+// and count pairs of the buckets with samples
+type wireStatistics struct {
+	ID               string         `json:"id"`
+	Role             role           `json:"role"`
+	Topic            string         `json:"topic"`
+	Filter           string         `json:"filter"`
+	Sent             int            `json:"sent"`
+	Received         int            `json:"received"`
+	Expected         int            `json:"expected"`
+	Topics           map[string]int `json:"topics,omitempty"`
+	OtherTopics      int            `json:"other_topics,omitempty"`
+	Lost             int            `json:"lost"`
+	Reordered        int            `json:"reordered"`
+	FirstReorder     string         `json:"first_reorder,omitempty"`
+	WrongTopics      int            `json:"wrong_topics"`
+	FirstWrongTopic  string         `json:"first_wrong_topic,omitempty"`
+	MaxBacklog       int64          `json:"max_backlog"`
+	Discarded        int            `json:"discarded"`
+	Foreign          int            `json:"foreign,omitempty"`
+	Start            time.Time      `json:"start"`
+	TimeTaken        time.Duration  `json:"time_taken"`
+	TotalSize        int            `json:"total_size"`
+	MinLatency       time.Duration  `json:"min_latency"`
+	MaxLatency       time.Duration  `json:"max_latency"`
+	AvgLatency       time.Duration  `json:"avg_latency"`
+	ConnectTime      time.Duration  `json:"connect_time"`
+	Reused           bool           `json:"reused,omitempty"`
+	SessionPresent   bool           `json:"session_present"`
+	AssignedID       string         `json:"assigned_id,omitempty"`
+	LostSessions     int            `json:"lost_sessions"`
+	LastReceived     time.Time      `json:"last_received"`
+	Uncorrelated     int            `json:"uncorrelated"`
+	Duplicates       []string       `json:"duplicates,omitempty"`
+	Missing          int            `json:"missing"`
+	MissingSequences []string       `json:"missing_sequences,omitempty"`
+	Latencies        [][2]uint64    `json:"latencies"`
+	Reconnects       [][2]uint64    `json:"reconnects"`
+	Acks             [][2]uint64    `json:"acks"`
+	Sends            [][2]uint64    `json:"sends"`
+	Sizes            [][2]uint64    `json:"sizes"`
+	Arrivals         [][2]uint64    `json:"arrivals"`
+	RoundTrips       [][2]uint64    `json:"round_trips"`
+	BurstPhases      [][][2]uint64  `json:"burst_phases,omitempty"`
+	BurstSlices      [][][2]uint64  `json:"burst_slices,omitempty"`
+}
+
+func toWire(s *Statistics) *wireStatistics {
+	w := &wireStatistics{
+		ID:               s.id,
+		Role:             s.role,
+		Topic:            s.topic,
+		Filter:           s.filter,
+		Sent:             s.sent,
+		Received:         s.received,
+		Expected:         s.expected,
+		Topics:           s.perTopic.counts,
+		OtherTopics:      s.perTopic.other,
+		Lost:             s.lost,
+		Reordered:        s.reordered,
+		FirstReorder:     s.firstReorder,
+		WrongTopics:      s.wrongTopics,
+		FirstWrongTopic:  s.firstWrongTopic,
+		MaxBacklog:       s.maxBacklog,
+		Discarded:        s.discarded,
+		Foreign:          s.foreign,
+		Start:            s.start,
+		TimeTaken:        s.timeTaken,
+		TotalSize:        s.totalSize,
+		MinLatency:       s.minLatency,
+		MaxLatency:       s.maxLatency,
+		AvgLatency:       s.avgLatency,
+		ConnectTime:      s.connectTime,
+		Reused:           s.reused,
+		SessionPresent:   s.connack.sessionPresent,
+		AssignedID:       s.connack.assignedID,
+		LostSessions:     s.lostSessions,
+		LastReceived:     s.lastReceived,
+		Uncorrelated:     s.uncorrelated,
+		Duplicates:       s.duplicates,
+		Missing:          s.missing,
+		MissingSequences: s.missingSequences,
+		Latencies:        s.latencies.sparse(),
+		Reconnects:       s.reconnects.sparse(),
+		Acks:             s.acks.sparse(),
+		Sends:            s.sends.sparse(),
+		Sizes:            s.sizes.sparse(),
+		Arrivals:         s.arrivals.sparse(),
+		RoundTrips:       s.roundTrips.sparse(),
+	}
+
+	if s.bursts != nil {
+		for i := range s.bursts.phases {
+			w.BurstPhases = append(w.BurstPhases, s.bursts.phases[i].sparse())
+		}
+
+		for i := range s.bursts.slices {
+			w.BurstSlices = append(w.BurstSlices, s.bursts.slices[i].sparse())
+		}
+	}
+
+	return w
+}
+
+func (w *wireStatistics) statistics() Statistics {
+	s := Statistics{
+		id:               w.ID,
+		role:             w.Role,
+		topic:            w.Topic,
+		filter:           w.Filter,
+		sent:             w.Sent,
+		received:         w.Received,
+		expected:         w.Expected,
+		perTopic:         topicCounts{counts: w.Topics, other: w.OtherTopics},
+		lost:             w.Lost,
+		reordered:        w.Reordered,
+		firstReorder:     w.FirstReorder,
+		wrongTopics:      w.WrongTopics,
+		firstWrongTopic:  w.FirstWrongTopic,
+		maxBacklog:       w.MaxBacklog,
+		discarded:        w.Discarded,
+		foreign:          w.Foreign,
+		start:            w.Start,
+		timeTaken:        w.TimeTaken,
+		totalSize:        w.TotalSize,
+		minLatency:       w.MinLatency,
+		maxLatency:       w.MaxLatency,
+		avgLatency:       w.AvgLatency,
+		connectTime:      w.ConnectTime,
+		reused:           w.Reused,
+		connack:          connack{sessionPresent: w.SessionPresent, assignedID: w.AssignedID},
+		lostSessions:     w.LostSessions,
+		lastReceived:     w.LastReceived,
+		uncorrelated:     w.Uncorrelated,
+		duplicates:       w.Duplicates,
+		missing:          w.Missing,
+		missingSequences: w.MissingSequences,
+		latencies:        fromSparse(w.Latencies),
+		reconnects:       fromSparse(w.Reconnects),
+		acks:             fromSparse(w.Acks),
+		sends:            fromSparse(w.Sends),
+		sizes:            fromSparse(w.Sizes),
+		arrivals:         fromSparse(w.Arrivals),
+		roundTrips:       fromSparse(w.RoundTrips),
+	}
+
+	if len(w.BurstPhases) > 0 && len(w.BurstSlices) == burstSlices {
+		s.bursts = newBurstLatencies(len(w.BurstPhases))
+		for i, phase := range w.BurstPhases {
+			s.bursts.phases[i].merge(fromSparse(phase))
+		}
+
+		for i, slice := range w.BurstSlices {
+			s.bursts.slices[i].merge(fromSparse(slice))
+		}
+	}
+
+	return s
+}
+
+// sparse lists the index and count of the buckets with samples
+func (h *histogram) sparse() [][2]uint64 {
+	var pairs [][2]uint64
+	if h == nil {
+		return nil
+	}
+
+	for i, count := range h.counts {
+		if count > 0 {
+			pairs = append(pairs, [2]uint64{uint64(i), count})
+		}
+	}
+
+	return pairs
+}
+
+// fromSparse is the histogram of pairs from sparse, nil without any. Buckets
+// out of range, which no sender of this version writes, are left out
+func fromSparse(pairs [][2]uint64) *histogram {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	h := new(histogram)
+	for _, pair := range pairs {
+		if pair[0] < histogramBuckets {
+			h.counts[pair[0]] += pair[1]
+			h.total += pair[1]
+		}
+	}
+
+	return h
+}
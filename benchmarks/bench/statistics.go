@@ -0,0 +1,254 @@
+package bench
+
+import "time"
+
+type Statistics struct {
+	id   string
+	role role
+	// topic is what the connection publishes to, before Config.Topics, and
+	// filter what it subscribes to
+	topic    string
+	filter   string
+	sent     int
+	received int
+	// expected is the number of messages the connection should receive, -1
+	// when that isn't known upfront
+	expected int
+	// perTopic is received by topic
+	perTopic topicCounts
+	// lost is the number of messages missing from the sequences received.
+	// Losses after the last received message of a publisher can't be seen
+	lost int
+	// reordered is the number of messages which arrived after a later one from
+	// the same publisher, and firstReorder the first of them. --verify-order
+	reordered    int
+	firstReorder string
+	// wrongTopics is the number of messages which arrived on another topic
+	// than they were published to, with --topic-alias
+	wrongTopics     int
+	firstWrongTopic string
+	// maxBacklog is the most messages published but not received yet at an
+	// arrival, with --fan-in
+	maxBacklog int64
+	// discarded is the number of messages received from the warmup
+	discarded int
+	// foreign is the number of messages too short to carry the header
+	foreign int
+	// start is when measurement began and timeTaken how long it lasted.
+	// Publishing connections are timed till their last publish and
+	// subscribers till their last message
+	start      time.Time
+	timeTaken  time.Duration
+	totalSize  int
+	minLatency time.Duration
+	maxLatency time.Duration
+	avgLatency time.Duration
+	// latencies and the other histograms are nil when the run doesn't use
+	// them
+	latencies *histogram
+	// bursts is the latencies through the cycles of Config.Burst. nil
+	// without it
+	bursts *burstLatencies
+	// connectTime is how long the broker took to accept the connection. 0
+	// for a client reused from the previous phase with --reuse-connections
+	connectTime time.Duration
+	reused      bool
+	// connack is the broker's answer to the first connect, and lostSessions
+	// the --churn reconnects which didn't get their session back with
+	// --clean-session=false
+	connack      connack
+	lostSessions int
+	// lastReceived is when the last message arrived. Zero without any
+	lastReceived time.Time
+	// reconnects holds the connect times of --churn reconnects
+	reconnects *histogram
+	// acks holds the time from each QoS 1 and 2 publish being sent till its
+	// acknowledgement, the broker's round trip, and sends the time the client
+	// took to send each publish. Throughput includes both
+	acks  *histogram
+	sends *histogram
+	// sizes is the histogram of published message sizes, a nanosecond per
+	// byte
+	sizes *histogram
+	// arrivals holds the times between consecutive messages, for --probe
+	arrivals *histogram
+	// roundTrips holds the times from each request till its reply, and
+	// uncorrelated counts the replies which didn't match their request, with
+	// --request-response
+	roundTrips   *histogram
+	uncorrelated int
+	// duplicates and missingSequences describe the anomalies found by
+	// --verify-qos2. missing counts messages which were expected but never
+	// received, including ones from publishers which were never heard from
+	duplicates       []string
+	missing          int
+	missingSequences []string
+}
+
+// throughput is the rate of publishes. Every publish is received once per
+// subscriber of its topic, so receiveThroughput is a multiple of this with
+// shared topics
+func (s *Statistics) throughput() float64 {
+	return float64(s.sent) / s.timeTaken.Seconds()
+}
+
+// receiveThroughput is the rate of messages delivered to subscribers
+func (s *Statistics) receiveThroughput() float64 {
+	return float64(s.received) / s.timeTaken.Seconds()
+}
+
+// lossPercent is the percentage of the messages which were lost, of the ones
+// which should have been received
+func (s *Statistics) lossPercent() float64 {
+	if s.received+s.lost == 0 {
+		return 0
+	}
+
+	return float64(s.lost) * 100 / float64(s.received+s.lost)
+}
+
+// meanSize is the average size of the published messages
+func (s *Statistics) meanSize() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+
+	return float64(s.totalSize) / float64(s.sent)
+}
+
+// mbps is the rate of published payload bytes
+func (s *Statistics) mbps() float64 {
+	return float64(s.totalSize) / s.timeTaken.Seconds() / 1e6
+}
+
+// Aggregate summarizes the run across all connections with the same
+// definitions as Statistics, over the wall clock span from the first
+// connection's start till the last publish or receive of any connection.
+// Its receiveThroughput is the headline number of the run
+type Aggregate struct {
+	Statistics
+	end         time.Time
+	connections int
+	publishers  int
+	failed      int
+	// reused is the number of connections with a client from the previous
+	// phase, which the connect times leave out
+	reused int
+	// sessionsPresent is the number of connections which the broker told
+	// of a session on connecting
+	sessionsPresent int
+	// topics is the number of distinct topics published to
+	topics      int
+	interrupted bool
+	// concurrency is the most connections publishing at once with
+	// Config.Workers
+	concurrency int
+	// aliasSaved is the bytes Config.TopicAlias saved and aliasTopics the
+	// topic bytes which would have been sent without it
+	aliasSaved  int64
+	aliasTopics int64
+
+	minConnect   time.Duration
+	maxConnect   time.Duration
+	totalConnect time.Duration
+}
+
+func newAggregate() Aggregate {
+	return Aggregate{Statistics: Statistics{id: "total", latencies: new(histogram), reconnects: new(histogram), acks: new(histogram), sends: new(histogram), sizes: new(histogram), arrivals: new(histogram), roundTrips: new(histogram)}}
+}
+
+func (a *Aggregate) add(s Statistics) {
+	if s.received > 0 && (a.received == 0 || s.minLatency < a.minLatency) {
+		a.minLatency = s.minLatency
+	}
+
+	if s.maxLatency > a.maxLatency {
+		a.maxLatency = s.maxLatency
+	}
+
+	// weighted by the number of messages received on each connection
+	total := a.avgLatency*time.Duration(a.received) + s.avgLatency*time.Duration(s.received)
+	a.sent += s.sent
+	a.received += s.received
+	a.perTopic.merge(&s.perTopic)
+	if s.bursts != nil {
+		if a.bursts == nil {
+			a.bursts = newBurstLatencies(len(s.bursts.phases))
+		}
+
+		a.bursts.merge(s.bursts)
+	}
+
+	a.lost += s.lost
+	a.reordered += s.reordered
+	if a.firstReorder == "" && s.firstReorder != "" {
+		a.firstReorder = s.id + ": " + s.firstReorder
+	}
+
+	a.wrongTopics += s.wrongTopics
+	a.maxBacklog = max(a.maxBacklog, s.maxBacklog)
+	if a.firstWrongTopic == "" && s.firstWrongTopic != "" {
+		a.firstWrongTopic = s.id + ": " + s.firstWrongTopic
+	}
+
+	a.uncorrelated += s.uncorrelated
+	a.discarded += s.discarded
+	a.foreign += s.foreign
+	a.missing += s.missing
+	a.duplicates = append(a.duplicates, s.duplicates...)
+	a.totalSize += s.totalSize
+	if a.received > 0 {
+		a.avgLatency = total / time.Duration(a.received)
+	}
+
+	if s.reused {
+		a.reused++
+	} else {
+		if a.connections == a.reused || s.connectTime < a.minConnect {
+			a.minConnect = s.connectTime
+		}
+
+		a.maxConnect = max(a.maxConnect, s.connectTime)
+		a.totalConnect += s.connectTime
+	}
+
+	a.lostSessions += s.lostSessions
+	if s.connack.sessionPresent {
+		a.sessionsPresent++
+	}
+
+	if a.connections == 0 || s.start.Before(a.start) {
+		a.start = s.start
+	}
+
+	end := s.start.Add(s.timeTaken)
+	if s.lastReceived.After(end) {
+		end = s.lastReceived
+	}
+
+	if end.After(a.end) {
+		a.end = end
+	}
+
+	a.timeTaken = a.end.Sub(a.start)
+	a.latencies.merge(s.latencies)
+	a.reconnects.merge(s.reconnects)
+	a.acks.merge(s.acks)
+	a.sends.merge(s.sends)
+	a.sizes.merge(s.sizes)
+	a.arrivals.merge(s.arrivals)
+	a.roundTrips.merge(s.roundTrips)
+	if s.role.publishes() {
+		a.publishers++
+	}
+
+	a.connections++
+}
+
+func (a *Aggregate) avgConnect() time.Duration {
+	if a.connections == a.reused {
+		return 0
+	}
+
+	return a.totalConnect / time.Duration(a.connections-a.reused)
+}
@@ -0,0 +1,50 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregateConnect(t *testing.T) {
+	tests := []struct {
+		name                      string
+		connects                  []time.Duration
+		reused                    int
+		wantMin, wantAvg, wantMax time.Duration
+	}{
+		{name: "connected", connects: []time.Duration{2 * time.Millisecond, 4 * time.Millisecond}, wantMin: 2 * time.Millisecond, wantAvg: 3 * time.Millisecond, wantMax: 4 * time.Millisecond},
+		{name: "reused first", connects: []time.Duration{3 * time.Millisecond, 5 * time.Millisecond}, reused: 2, wantMin: 3 * time.Millisecond, wantAvg: 4 * time.Millisecond, wantMax: 5 * time.Millisecond},
+		{name: "all reused", reused: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAggregate()
+			// reused clients come first, as a phase reconnects the rest
+			for i := 0; i < test.reused; i++ {
+				a.add(Statistics{id: "reused", reused: true})
+			}
+
+			for _, d := range test.connects {
+				a.add(Statistics{id: "connected", connectTime: d})
+			}
+
+			if a.minConnect != test.wantMin || a.avgConnect() != test.wantAvg || a.maxConnect != test.wantMax {
+				t.Errorf("connect (min/avg/max) = %v / %v / %v, want %v / %v / %v", a.minConnect, a.avgConnect(), a.maxConnect, test.wantMin, test.wantAvg, test.wantMax)
+			}
+
+			if a.reused != test.reused || a.connections != test.reused+len(test.connects) {
+				t.Errorf("%v reused of %v connections, want %v of %v", a.reused, a.connections, test.reused, test.reused+len(test.connects))
+			}
+		})
+	}
+}
+
+func TestAggregateForeign(t *testing.T) {
+	a := newAggregate()
+	a.add(Statistics{id: "a", foreign: 2})
+	a.add(Statistics{id: "b", foreign: 3})
+	if a.foreign != 5 {
+		t.Errorf("foreign = %v, want 5", a.foreign)
+	}
+}
@@ -0,0 +1,43 @@
+package bench
+
+import (
+	"path/filepath"
+
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// memoryStore is Config.Store for paho's default of keeping the session in
+// memory
+const memoryStore = "memory"
+
+// store3 is where an mqtt 3 client keeps the QoS 1 and 2 messages it hasn't
+// had acknowledged, in a directory of its own under Config.Store
+func (r *Runner) store3(id string) mqtt.Store {
+	if r.opts.Store == memoryStore {
+		return mqtt.NewMemoryStore()
+	}
+
+	return mqtt.NewFileStore(filepath.Join(r.opts.Store, id))
+}
+
+// session5 is the session state of an mqtt 5 client, like store3 for mqtt 3
+func (r *Runner) session5(id string) (*state.State, error) {
+	if r.opts.Store == memoryStore {
+		return state.NewInMemory(), nil
+	}
+
+	dir := filepath.Join(r.opts.Store, id)
+	client, err := file.New(dir, "client-", ".pkt")
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := file.New(dir, "server-", ".pkt")
+	if err != nil {
+		return nil, err
+	}
+
+	return state.New(client, server), nil
+}
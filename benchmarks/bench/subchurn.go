@@ -0,0 +1,151 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SubChurnReport is the outcome of a Config.SubChurn run, which measures the
+// broker adding and removing subscriptions rather than routing messages
+type SubChurnReport struct {
+	Connections       int     `json:"connections"`
+	FailedConnections int     `json:"failed_connections"`
+	Subscribes        int     `json:"subscribes"`
+	Unsubscribes      int     `json:"unsubscribes"`
+	FailedOperations  int     `json:"failed_operations"`
+	DurationMillis    int64   `json:"duration_ms"`
+	Throughput        float64 `json:"operations_per_sec"`
+	// Suback is the time from each subscribe till its SUBACK, and Unsuback
+	// from each unsubscribe till its UNSUBACK
+	Suback   *PercentileReport `json:"suback_latency"`
+	Unsuback *PercentileReport `json:"unsuback_latency"`
+
+	subacks, unsubacks *histogram
+}
+
+// churner is a connection of a Config.SubChurn run and the filters it goes
+// round
+type churner struct {
+	id      string
+	client  client
+	filters []string
+
+	subscribes, unsubscribes, failed int
+	subacks, unsubacks               histogram
+}
+
+// churnSubscriptions connects -c clients which subscribe to every one of their
+// filters and unsubscribe from them again, -m times or for Config.Duration.
+// Each subscribe and unsubscribe is its own packet, waited on before the next
+func (r *Runner) churnSubscriptions(ctx context.Context) (*Report, error) {
+	opts := &r.opts
+	var churners []*churner
+	failed := 0
+	for i := 0; i < opts.Connections; i++ {
+		id := fmt.Sprintf("%v-%d", r.clientPrefix, i)
+		client, err := r.connect(id, r.brokers[i%len(r.brokers)], nil)
+		if err != nil {
+			r.log.Warn("connection failed", "id", id, "err", err)
+			failed++
+			continue
+		}
+
+		// the published topics with Config.Topics, which a subscriber would
+		// otherwise match with one wildcard
+		filters := []string{r.subscription(r.filter(i))}
+		if opts.Topics > 1 {
+			filters = make([]string, opts.Topics)
+			for k := range filters {
+				filters[k] = r.subscription(r.topic(i) + "/" + strconv.Itoa(k))
+			}
+		}
+
+		churners = append(churners, &churner{id: id, client: client, filters: filters})
+	}
+
+	if len(churners) == 0 {
+		return nil, fmt.Errorf("all %v connections failed", failed)
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, c := range churners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.client.Disconnect()
+			r.churnFilters(ctx, c)
+		}()
+	}
+
+	wg.Wait()
+	timeTaken := time.Since(start)
+	churn := &SubChurnReport{
+		Connections:       len(churners),
+		FailedConnections: failed,
+		DurationMillis:    timeTaken.Milliseconds(),
+		subacks:           new(histogram),
+		unsubacks:         new(histogram),
+	}
+
+	for _, c := range churners {
+		churn.Subscribes += c.subscribes
+		churn.Unsubscribes += c.unsubscribes
+		churn.FailedOperations += c.failed
+		churn.subacks.merge(&c.subacks)
+		churn.unsubacks.merge(&c.unsubacks)
+	}
+
+	churn.Throughput = float64(churn.Subscribes+churn.Unsubscribes) / timeTaken.Seconds()
+	churn.Suback, churn.Unsuback = percentiles(churn.subacks), percentiles(churn.unsubacks)
+	report := &Report{SubChurn: churn, Errors: r.failures(), opts: *opts}
+	if failed > 0 {
+		report.Violations = append(report.Violations, fmt.Sprintf("%v of %v connections failed", failed, opts.Connections))
+	}
+
+	if churn.FailedOperations > 0 {
+		report.Violations = append(report.Violations, fmt.Sprintf("%v subscribes or unsubscribes failed", churn.FailedOperations))
+	}
+
+	return report, nil
+}
+
+// churnFilters runs the cycles of one connection till -m are done or ctx is.
+// A cycle is interrupted between operations, not in the middle of one
+func (r *Runner) churnFilters(ctx context.Context, c *churner) {
+	qos := byte(r.opts.SubQos)
+	for cycle := 0; (r.opts.Duration > 0 || cycle < r.opts.Messages) && ctx.Err() == nil; cycle++ {
+		for _, filter := range c.filters {
+			at := time.Now()
+			if err := c.client.Subscribe(filter, qos, nil); err != nil {
+				c.failed++
+				r.fail(c.id, subscribeFailed, err)
+				continue
+			}
+
+			c.subacks.record(time.Since(at))
+			c.subscribes++
+		}
+
+		for _, filter := range c.filters {
+			at := time.Now()
+			if err := c.client.Unsubscribe(filter); err != nil {
+				c.failed++
+				r.fail(c.id, subscribeFailed, err)
+				continue
+			}
+
+			c.unsubacks.record(time.Since(at))
+			c.unsubscribes++
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// maxTopicCounts bounds the topics counted one by one. Messages on topics past
+// it, like dynamically generated ones, are only counted together
+const maxTopicCounts = 1000
+
+// TopicReport is what subscribers received on one topic, for hot and cold
+// topics behind the aggregate
+type TopicReport struct {
+	Topic    string  `json:"topic"`
+	Received int     `json:"received"`
+	Receive  float64 `json:"receive_throughput_msgs_per_sec"`
+}
+
+// topicCounts counts the messages received per topic, up to maxTopicCounts
+// topics
+type topicCounts struct {
+	counts map[string]int
+	// other counts the messages on the topics past maxTopicCounts
+	other int
+}
+
+func (t *topicCounts) add(topic string, n int) {
+	if t.counts == nil {
+		t.counts = make(map[string]int)
+	}
+
+	if _, ok := t.counts[topic]; !ok && len(t.counts) >= maxTopicCounts {
+		t.other += n
+		return
+	}
+
+	t.counts[topic] += n
+}
+
+func (t *topicCounts) merge(other *topicCounts) {
+	for topic, n := range other.counts {
+		t.add(topic, n)
+	}
+
+	t.other += other.other
+}
+
+// clone copies the counts, which the message handler keeps changing
+func (t *topicCounts) clone() topicCounts {
+	clone := topicCounts{other: t.other}
+	clone.merge(&topicCounts{counts: t.counts})
+	return clone
+}
+
+// topicReports lists the topics of the aggregate by the messages received,
+// the busiest first. nil unless messages arrived on more than one topic
+func (a *Aggregate) topicReports() []TopicReport {
+	if len(a.perTopic.counts) < 2 {
+		return nil
+	}
+
+	reports := make([]TopicReport, 0, len(a.perTopic.counts))
+	for topic, n := range a.perTopic.counts {
+		reports = append(reports, TopicReport{Topic: topic, Received: n, Receive: float64(n) / a.timeTaken.Seconds()})
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Received != reports[j].Received {
+			return reports[i].Received > reports[j].Received
+		}
+
+		return reports[i].Topic < reports[j].Topic
+	})
+
+	return reports
+}
+
+// writeTopics writes the per topic breakdown. With many topics only the
+// busiest and quietest ones, where skew shows
+func (r *Report) writeTopics(w io.Writer) {
+	const shown = 10
+	fmt.Fprintln(w, "Per topic (received, messages/sec):")
+	for i, topic := range r.Topics {
+		if len(r.Topics) > 2*shown && i == shown {
+			fmt.Fprintln(w, "    ...", len(r.Topics)-2*shown, "more")
+		}
+
+		if len(r.Topics) > 2*shown && i >= shown && i < len(r.Topics)-shown {
+			continue
+		}
+
+		fmt.Fprintln(w, "   ", topic.Topic, "=", topic.Received, ",", int64(topic.Receive))
+	}
+
+	if r.OtherTopics > 0 {
+		fmt.Fprintln(w, "    Topics past the first", maxTopicCounts, "=", r.OtherTopics)
+	}
+}
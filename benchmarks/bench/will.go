@@ -0,0 +1,122 @@
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// testWills connects -c clients with a will and a subscriber to the wills,
+// kills the clients and reports whether the broker delivered every will
+// within Config.WillTimeout. Latency is from the kill to the will's arrival
+func (r *Runner) testWills(ctx context.Context) (*Report, error) {
+	var (
+		mu        sync.Mutex
+		killed    = make(map[uint32]time.Time)
+		delivered = make(map[uint32]bool)
+		latencies histogram
+		done      = make(chan struct{})
+	)
+
+	opts := &r.opts
+	filter := r.clientPrefix + "/will/+"
+	watcher, err := r.connect(r.clientPrefix+"-will-watcher", r.brokers[0], nil)
+	if err != nil {
+		return nil, fmt.Errorf("will watcher connect failed: %v", err)
+	}
+
+	defer watcher.Disconnect()
+	err = watcher.Subscribe(filter, byte(opts.SubQos), func(topic string, payload []byte, _ *request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(payload) < 4 {
+			r.log.Warn("undecodable will", "topic", topic)
+			return
+		}
+
+		index := binary.LittleEndian.Uint32(payload)
+		at, ok := killed[index]
+		if !ok || delivered[index] {
+			r.log.Warn("unexpected will", "topic", topic)
+			return
+		}
+
+		delivered[index] = true
+		latencies.record(time.Since(at))
+		if len(delivered) == len(killed) {
+			close(done)
+		}
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("will watcher subscribe to %v failed: %v", filter, err)
+	}
+
+	var victims []client
+	for i := 0; i < opts.Connections; i++ {
+		id := fmt.Sprintf("%v-will-%d", r.clientPrefix, i)
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, uint32(i))
+		will := &will{topic: fmt.Sprintf("%v/will/%d", r.clientPrefix, i), payload: payload}
+		victim, err := r.connect(id, r.brokers[i%len(r.brokers)], will)
+		if err != nil {
+			r.log.Warn("connection failed", "id", id, "err", err)
+			victims = append(victims, nil)
+			continue
+		}
+
+		victims = append(victims, victim)
+	}
+
+	mu.Lock()
+	for i, victim := range victims {
+		if victim != nil {
+			killed[uint32(i)] = time.Now()
+			victim.Kill()
+		}
+	}
+
+	n := len(killed)
+	mu.Unlock()
+	if n == 0 {
+		return nil, fmt.Errorf("all %v connections failed", opts.Connections)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(opts.WillTimeout):
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := uint32(0); i < uint32(len(victims)); i++ {
+		if _, ok := killed[i]; ok && !delivered[i] {
+			r.log.Warn("will not delivered", "id", fmt.Sprintf("%v-will-%d", r.clientPrefix, i), "timeout", opts.WillTimeout)
+		}
+	}
+
+	wills := &WillReport{
+		Killed:            len(killed),
+		Delivered:         len(delivered),
+		FailedConnections: opts.Connections - len(killed),
+		P50Millis:         millis(latencies.percentile(50)),
+		P95Millis:         millis(latencies.percentile(95)),
+		P99Millis:         millis(latencies.percentile(99)),
+		latencies:         &latencies,
+	}
+
+	report := &Report{Wills: wills, opts: *opts}
+	if wills.FailedConnections > 0 {
+		report.Violations = append(report.Violations, fmt.Sprintf("%v of %v connections failed", wills.FailedConnections, opts.Connections))
+	}
+
+	if wills.Delivered < wills.Killed {
+		report.Violations = append(report.Violations, fmt.Sprintf("%v of %v wills were not delivered", wills.Killed-wills.Delivered, wills.Killed))
+	}
+
+	return report, nil
+}
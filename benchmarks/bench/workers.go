@@ -0,0 +1,159 @@
+package bench
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// activity is what publishing did on a connection, for finish
+type activity struct {
+	sent      int
+	start     time.Time
+	timeTaken time.Duration
+}
+
+// runWorkers runs the connections with no more than Config.Workers
+// goroutines. The workers publish from one connection at a time, then wait
+// together for the messages still on their way, then finish the connections.
+// Subscribers don't take a worker to receive, the clients deliver to them
+// while the publishers go
+func (r *Runner) runWorkers(ctx context.Context, connections []*connection, template []byte, published *sync.WaitGroup, drained <-chan struct{}) []Statistics {
+	begin := time.Now()
+	activities := make([]activity, len(connections))
+	r.work(connections, func(i int) {
+		c := connections[i]
+		if !c.role.publishes() {
+			return
+		}
+
+		// the copy is restamped for every message, as in Start
+		payload := append([]byte(nil), template...)
+		c.warmup(ctx, payload)
+		r.busy(1)
+		start := time.Now()
+		sent := c.publish(ctx, payload)
+		activities[i] = activity{sent: sent, start: start, timeTaken: time.Since(start)}
+		r.busy(-1)
+		published.Done()
+	})
+
+	// subscribers start with the measurement, as in Start
+	start := begin
+	if measured := r.measureStart(); measured.After(start) {
+		start = measured
+	}
+
+	for i, c := range connections {
+		if !c.role.publishes() {
+			activities[i].start = start
+		}
+	}
+
+	quiet := r.settle(ctx, connections, drained)
+	stats := make(chan Statistics, len(connections))
+	r.work(connections, func(i int) {
+		a, c := activities[i], connections[i]
+		select {
+		case <-c.done:
+			c.finish(a.sent, a.start, a.timeTaken, false, stats)
+		default:
+			c.finish(a.sent, a.start, a.timeTaken, quiet, stats)
+		}
+	})
+
+	results := make([]Statistics, 0, len(connections))
+	for range connections {
+		results = append(results, <-stats)
+	}
+
+	return results
+}
+
+// busy counts connections starting or stopping to publish, and keeps the peak
+func (r *Runner) busy(delta int64) {
+	active := r.active.Add(delta)
+	for peak := r.peakActive.Load(); active > peak; peak = r.peakActive.Load() {
+		if r.peakActive.CompareAndSwap(peak, active) {
+			return
+		}
+	}
+}
+
+// work calls do with the index of every connection from Config.Workers
+// goroutines, and returns once they are all done
+func (r *Runner) work(connections []*connection, do func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(r.opts.Workers, len(connections)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				do(i)
+			}
+		}()
+	}
+
+	for i := range connections {
+		next <- i
+	}
+
+	close(next)
+	wg.Wait()
+}
+
+// settle waits like connection.wait, but for all the connections at once
+// rather than a worker each: till every expected message is received, ctx
+// is done or, once drained is closed, no messages arrive for Config.Drain.
+// Returns true in that last case
+func (r *Runner) settle(ctx context.Context, connections []*connection, drained <-chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-drained:
+	}
+
+	ticker := time.NewTicker(r.opts.Drain)
+	defer ticker.Stop()
+	last := r.count(connections)
+	for !r.received(connections) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		count := r.count(connections)
+		if count == last {
+			return true
+		}
+
+		last = count
+	}
+
+	return false
+}
+
+// count is the number of messages which arrived on the connections
+func (r *Runner) count(connections []*connection) int {
+	count := 0
+	for _, c := range connections {
+		count += c.count()
+	}
+
+	return count
+}
+
+// received is whether every connection received what it expected
+func (r *Runner) received(connections []*connection) bool {
+	for _, c := range connections {
+		select {
+		case <-c.done:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,10 +1,17 @@
 module paho
 
-go 1.14
+go 1.24.0
 
 require (
 	github.com/alexflint/go-arg v1.3.0
-	github.com/eclipse/paho.mqtt.golang v1.2.0
-	github.com/schollz/progressbar/v2 v2.15.0
-	golang.org/x/net v0.0.0-20200602114024-627f9648deb9 // indirect
+	github.com/eclipse/paho.golang v0.23.0
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	golang.org/x/net v0.44.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/alexflint/go-scalar v1.0.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	golang.org/x/sync v0.17.0 // indirect
 )
@@ -1,78 +1,136 @@
 package main
 
 import (
-	"fmt"
-	"math/rand"
-	"time"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	arg "github.com/alexflint/go-arg"
-	mqtt "github.com/eclipse/paho.mqtt.golang"
-)
-
-var opts struct {
-	Messages    int `arg:"-m" help:"Number of messages per connection"`
-	PayloadSize int `arg:"-s" help:"Size of each message"`
-}
 
-func init() {
-	opts.Messages = 1000000
-	opts.PayloadSize = 100
+	"paho/bench"
+)
 
-	arg.MustParse(&opts)
+// repeated are the environment variables of the flags which can be repeated.
+// go-arg appends the flags to their values, so given flags replace them
+// instead, like other flags override theirs
+var repeated = map[string]string{
+	"--local-addr": "RUMQ_BENCH_LOCAL_ADDR",
+	"--ws-header":  "RUMQ_BENCH_WS_HEADER",
 }
 
-func data(n int) string {
-	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+func main() {
+	for _, flag := range os.Args[1:] {
+		name, _, _ := strings.Cut(flag, "=")
+		if env, ok := repeated[name]; ok {
+			os.Unsetenv(env)
+		}
 	}
 
-	return string(b)
-}
+	config := bench.DefaultConfig()
+	p := arg.MustParse(&config)
+	// the password's older variable, which go-arg has no second name for
+	if config.Password == "" {
+		config.Password = os.Getenv("RUMQ_PASSWORD")
+	}
 
-type Connection struct {
-	id     string
-	total  int
-	client mqtt.Client
-}
+	runner, err := bench.NewRunner(config)
+	if err != nil {
+		p.Fail(err.Error())
+	}
 
-func NewConnection(id string, total int) *Connection {
-	opts := mqtt.NewClientOptions().AddBroker("tcp://localhost:1883")
-	opts.SetClientID(id)
-	opts.SetProtocolVersion(4)
-	opts.SetCleanSession(true)
-	opts.SetKeepAlive(10 * time.Second)
+	defer runner.Close()
+	if config.DryRun {
+		runner.WritePlan(os.Stdout)
+		return
+	}
 
-	c := mqtt.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	log := runner.Logger()
+	ctx, cancel := context.WithCancel(context.Background())
+	// signal.Notify doesn't block, so room for both the interrupts handled
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("interrupted, collecting partial results. Interrupt again to exit immediately")
+		cancel()
+
+		<-signals
+		os.Exit(1)
+	}()
+
+	if config.Scenario != "" {
+		scenario, err := bench.LoadScenario(config.Scenario)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+
+		report, err := bench.RunScenario(ctx, config, scenario)
+		if report == nil {
+			log.Error("scenario failed", "err", err)
+			os.Exit(1)
+		}
+
+		var reports []*bench.Report
+		for _, phase := range report.Phases {
+			reports = append(reports, phase.Report)
+		}
+
+		// the phases before a failed one are still written
+		violations := report.Combined.Violations
+		if err != nil {
+			violations = append(violations, "scenario failed: "+err.Error())
+		}
+
+		write(config, report, reports, violations, log)
+		return
 	}
 
-	return &Connection{
-		id:     id,
-		client: c,
-		total:  total,
+	report, err := runner.Run(ctx)
+	if err != nil {
+		log.Error("run failed", "err", err)
+		os.Exit(1)
 	}
+
+	write(config, report, []*bench.Report{report}, report.Violations, log)
 }
 
-func (c *Connection) Start() {
-	var start = time.Now()
+// results is a Report or ScenarioReport
+type results interface {
+	WriteJSON(w io.Writer) error
+	WriteText(w io.Writer)
+}
 
-	text := data(opts.PayloadSize)
-	for i := 0; i < c.total; i++ {
-		token := c.client.Publish("hello/world", 1, false, text)
-		token.Wait()
+// write prints the results, appends the connections of reports to the csv
+// file and exits 1 when there are violations
+func write(config bench.Config, r results, reports []*bench.Report, violations []string, log *slog.Logger) {
+	switch config.Output {
+	case "json":
+		if err := r.WriteJSON(os.Stdout); err != nil {
+			log.Error("failed to write json results", "err", err)
+			os.Exit(1)
+		}
+	default:
+		r.WriteText(os.Stdout)
 	}
 
-	timeTaken := time.Since(start).Milliseconds()
-	throughputMillis := int64(c.total) / timeTaken
-	fmt.Println("Id =", c.id, ", Messages =", c.total, ", Payload (bytes) =", opts.PayloadSize, ", Throughput (messages/sec) =", throughputMillis*1000)
-}
+	if config.Csv != "" {
+		for _, report := range reports {
+			if err := report.AppendCSV(config.Csv); err != nil {
+				log.Error("failed to write csv results", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
 
-func main() {
+	for _, violation := range violations {
+		log.Error("failed", "reason", violation)
+	}
 
-	connection := NewConnection("paho-go", opts.Messages)
-	connection.Start()
+	if len(violations) > 0 {
+		os.Exit(1)
+	}
 }